@@ -0,0 +1,124 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include <stdlib.h>
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"unsafe"
+
+	gopointer "github.com/mattn/go-pointer"
+)
+
+// startAsync queues a command whose result is delivered to tasks once
+// ProcessAsync (or ProcessAsyncN) services the connection.  request is
+// passed back as the TaskResult's Context.  Any data is copied so the
+// caller may reuse its buffer as soon as this returns.
+//
+// If the connection already has the maximum number of async commands in
+// flight this services the connection until one completes, so callers
+// must keep draining tasks or it can block forever.  The returned handle
+// can be passed to AbortTask
+func (d *device) startAsync(op string, request any, tasks chan TaskResult, data []byte,
+	start func(cb C.iscsi_command_cb, pdata unsafe.Pointer, buf *C.uchar) *C.struct_scsi_task,
+) (*TaskHandle, error) {
+	root := d.root()
+	for root.inFlight >= root.maxInFlight() {
+		if err := d.ProcessAsyncN(1); err != nil {
+			return nil, fmt.Errorf("waiting for a free slot for %s: %w", op, err)
+		}
+	}
+	if err := d.keepaliveErr(); err != nil {
+		return nil, fmt.Errorf("%s: %w", op, err)
+	}
+	root.connMu.Lock()
+	defer root.connMu.Unlock()
+
+	var buf unsafe.Pointer
+	if len(data) > 0 {
+		buf = C.CBytes(data)
+	}
+	handle := &TaskHandle{dev: d, op: op}
+	pdata := gopointer.Save(callbackData{
+		tasks:   tasks,
+		context: request,
+		op:      op,
+		dev:     root,
+		buf:     buf,
+		handle:  handle,
+	})
+	// can't call unref until the callback is done
+	task := start(channelCB, pdata, (*C.uchar)(buf))
+	if task == nil {
+		gopointer.Unref(pdata)
+		C.free(buf)
+		return nil, fmt.Errorf("unable to start %s: %s", op, C.GoString(C.iscsi_get_error(d.root().Context)))
+	}
+	handle.task = task
+	root.inFlight++
+	if root.pending == nil {
+		root.pending = map[*TaskHandle]struct{}{}
+	}
+	root.pending[handle] = struct{}{}
+	return handle, nil
+}
+
+func (d *device) maxInFlight() int {
+	if d.details.MaxInFlight > 0 {
+		return d.details.MaxInFlight
+	}
+	return defaultMaxInFlight
+}
+
+// InFlight returns how many async commands are waiting to complete
+// on the connection
+func (d *device) InFlight() int {
+	return d.root().inFlight
+}
+
+// Write16Async queues a WRITE(16), unlike Write16 it isn't split up so
+// data must fit within the target's transfer limits, see MaxTransferBlocks
+func (d *device) Write16Async(data Write16, tasks chan TaskResult) (*TaskHandle, error) {
+	if data.BlockSize <= 0 || len(data.Data) == 0 || len(data.Data)%data.BlockSize != 0 {
+		return nil, fmt.Errorf("Write16Async: data must be a multiple of the %d byte block size", data.BlockSize)
+	}
+	maxBlocks, err := d.maxTransferBlocks(context.Background(), data.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if blocks := len(data.Data) / data.BlockSize; blocks > maxBlocks {
+		return nil, fmt.Errorf("Write16Async: %d blocks is more than the %d a single command may transfer", blocks, maxBlocks)
+	}
+	return d.startAsync("iscsi_write16_task", data, tasks, data.Data,
+		func(cb C.iscsi_command_cb, pdata unsafe.Pointer, buf *C.uchar) *C.struct_scsi_task {
+			return C.iscsi_write16_task(d.root().Context, C.int(d.targetLun), C.uint64_t(data.LBA),
+				buf, C.uint(len(data.Data)), C.int(data.BlockSize), 0, 0, cBool(data.FUA), 0, 0, cb, pdata)
+		})
+}
+
+// WriteSame16Async queues a WRITE SAME(16).  NDOB isn't supported
+// here, use WriteSame16 for that
+func (d *device) WriteSame16Async(data WriteSame16, tasks chan TaskResult) (*TaskHandle, error) {
+	if data.NDOB {
+		return nil, errors.New("WriteSame16Async: NDOB is not supported")
+	}
+	if data.Blocks <= 0 {
+		return nil, errors.New("WriteSame16Async: blocks must be positive")
+	}
+	if len(data.Data) != data.BlockSize {
+		return nil, fmt.Errorf("WriteSame16Async: data must be exactly one block of %d bytes", data.BlockSize)
+	}
+	return d.startAsync("iscsi_writesame16_task", data, tasks, data.Data,
+		func(cb C.iscsi_command_cb, pdata unsafe.Pointer, buf *C.uchar) *C.struct_scsi_task {
+			return C.iscsi_writesame16_task(d.root().Context, C.int(d.targetLun), C.uint64_t(data.LBA),
+				buf, C.uint32_t(len(data.Data)), C.uint32_t(data.Blocks),
+				cBool(data.Anchor), cBool(data.Unmap), 0, 0, cb, pdata)
+		})
+}
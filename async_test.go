@@ -0,0 +1,98 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestWrite16Async(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	fileName := createTargetTempfile(t, 4*MiB)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+		MaxInFlight:  4,
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	const writes = 64
+	const blocks = 16
+	expected := make([]byte, writes*blocks*512)
+	_, _ = rnd.Read(expected)
+	results := make(chan iscsi.TaskResult, writes)
+	buf := make([]byte, blocks*512)
+	for i := 0; i < writes; i++ {
+		// reusing the buffer is fine since the data is copied
+		copy(buf, expected[i*len(buf):])
+		_, err := device.Write16Async(iscsi.Write16{LBA: i * blocks, Data: buf, BlockSize: 512}, results)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Assert(t, device.InFlight() <= 4)
+	}
+	for device.InFlight() > 0 {
+		if err := device.ProcessAsyncN(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(results)
+
+	lbas := map[int]bool{}
+	for r := range results {
+		assert.NilError(t, r.Err)
+		write, ok := r.Context.(iscsi.Write16)
+		assert.Assert(t, ok)
+		lbas[write.LBA] = true
+	}
+	assert.Equal(t, len(lbas), writes)
+
+	fileData, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(fileData[:len(expected)], expected))
+}
+
+func TestWrite16AsyncTooLarge(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 4*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	maxBlocks, err := device.MaxTransferBlocks(512)
+	assert.NilError(t, err)
+	results := make(chan iscsi.TaskResult, 1)
+	_, err = device.Write16Async(iscsi.Write16{LBA: 0, Data: make([]byte, (maxBlocks+1)*512), BlockSize: 512}, results)
+	assert.ErrorContains(t, err, "more than")
+	assert.Equal(t, device.InFlight(), 0)
+
+	_, err = device.Write16Async(iscsi.Write16{LBA: 0, Data: make([]byte, maxBlocks*512), BlockSize: 512}, results)
+	assert.NilError(t, err)
+	for device.InFlight() > 0 {
+		if err := device.ProcessAsyncN(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NilError(t, (<-results).Err)
+}
@@ -0,0 +1,197 @@
+package iscsi
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+)
+
+const (
+	defaultCacheSize       = 4 << 20
+	defaultCachePageBlocks = 8
+)
+
+type CacheOptions struct {
+	// Size is roughly how many bytes of data to keep, defaults to 4MiB
+	Size int
+	// PageBlocks is how many blocks are cached together, defaults to 8.
+	// A miss reads the whole page containing it
+	PageBlocks int
+}
+
+type CacheStats struct {
+	// Hits and Misses count pages rather than calls to ReadAt
+	Hits   uint64
+	Misses uint64
+}
+
+// blockCache is an LRU cache of pages of blocks, keyed by the lba of the
+// first block in the page
+type blockCache struct {
+	pageBlocks int
+	maxPages   int
+	pages      map[int64]*list.Element
+	lru        *list.List
+	hits       atomic.Uint64
+	misses     atomic.Uint64
+}
+
+type cachePage struct {
+	lba  int64
+	data []byte
+}
+
+func newBlockCache(opts CacheOptions, blocksize int) *blockCache {
+	if opts.Size <= 0 {
+		opts.Size = defaultCacheSize
+	}
+	if opts.PageBlocks <= 0 {
+		opts.PageBlocks = defaultCachePageBlocks
+	}
+	return &blockCache{
+		pageBlocks: opts.PageBlocks,
+		maxPages:   max(opts.Size/(opts.PageBlocks*blocksize), 1),
+		pages:      map[int64]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func (c *blockCache) get(lba int64) ([]byte, bool) {
+	e, ok := c.pages[lba]
+	if !ok {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	c.lru.MoveToFront(e)
+	return e.Value.(*cachePage).data, true
+}
+
+func (c *blockCache) put(lba int64, data []byte) {
+	if e, ok := c.pages[lba]; ok {
+		e.Value.(*cachePage).data = data
+		c.lru.MoveToFront(e)
+		return
+	}
+	c.pages[lba] = c.lru.PushFront(&cachePage{lba: lba, data: data})
+	for c.lru.Len() > c.maxPages {
+		oldest := c.lru.Remove(c.lru.Back()).(*cachePage)
+		delete(c.pages, oldest.lba)
+	}
+}
+
+// CachedReader is Reader with an LRU cache of blocks underneath, for
+// workloads like parsing filesystem metadata that do lots of small
+// reads of the same or neighbouring blocks.  The cache assumes nothing
+// else is writing to the LUN
+func CachedReader(dev *device, opts CacheOptions) (*reader, error) {
+	r, err := Reader(dev)
+	if err != nil {
+		return nil, err
+	}
+	r.cache = newBlockCache(opts, int(r.blocksize))
+	return r, nil
+}
+
+// CacheStats returns the hit and miss counts of the reader's cache,
+// which are zero when the reader wasn't created with CachedReader
+func (r *reader) CacheStats() CacheStats {
+	if r.cache == nil {
+		return CacheStats{}
+	}
+	return CacheStats{Hits: r.cache.hits.Load(), Misses: r.cache.misses.Load()}
+}
+
+func (r *reader) cachedReadAt(p []byte, off int64) (n int, err error) {
+	size := r.blocksize * r.lba
+	if off < 0 {
+		return 0, errors.New("iscsi.Reader.ReadAt: negative offset")
+	}
+	if off >= size {
+		return 0, io.EOF
+	}
+	end := off + int64(len(p))
+	if end >= size {
+		end = size
+		err = io.EOF
+	}
+	pageSize := int64(r.cache.pageBlocks) * r.blocksize
+	first := off / pageSize
+	last := (end - 1) / pageSize
+
+	// look everything up first so that runs of missing pages can be
+	// fetched with a single read
+	pages := make([][]byte, last-first+1)
+	missStart := int64(-1)
+	for i := first; i <= last; i++ {
+		data, ok := r.cache.get(i * int64(r.cache.pageBlocks))
+		if ok {
+			pages[i-first] = data
+			if missStart >= 0 {
+				if fillErr := r.fillPages(pages[missStart-first:i-first], missStart); fillErr != nil {
+					return 0, fillErr
+				}
+				missStart = -1
+			}
+			continue
+		}
+		if missStart < 0 {
+			missStart = i
+		}
+	}
+	if missStart >= 0 {
+		if fillErr := r.fillPages(pages[missStart-first:], missStart); fillErr != nil {
+			return 0, fillErr
+		}
+	}
+
+	pos := off
+	for i, page := range pages {
+		pageStart := (first + int64(i)) * pageSize
+		n += copy(p[n:end-off], page[pos-pageStart:])
+		pos = off + int64(n)
+	}
+	return n, err
+}
+
+// fillPages reads len(pages) consecutive pages starting at page number
+// first and adds them to the cache
+func (r *reader) fillPages(pages [][]byte, first int64) error {
+	pageBlocks := int64(r.cache.pageBlocks)
+	lba := first * pageBlocks
+	// the last page may run past the end of the device
+	endLBA := min((first+int64(len(pages)))*pageBlocks, r.lba)
+	for lba < endLBA {
+		logger().Debug("cache miss", slog.Int("lba", int(lba)), slog.Int("blocks", int(endLBA-lba)))
+		data, err := r.dev.Read16(Read16{
+			LBA:       int(lba),
+			Blocks:    int(endLBA - lba),
+			BlockSize: int(r.blocksize),
+		})
+		if err != nil {
+			return fmt.Errorf("iscsi device read error: %w", err)
+		}
+		// the target can send back fewer blocks than were asked for,
+		// keep whatever whole pages arrived and ask for the rest
+		start := lba
+		for len(data) > 0 {
+			pageLen := min(int64(len(data)), pageBlocks*r.blocksize, (r.lba-lba)*r.blocksize)
+			if pageLen < pageBlocks*r.blocksize && lba+pageLen/r.blocksize < r.lba {
+				// a partial page that isn't the last on the device
+				break
+			}
+			page := data[:pageLen:pageLen]
+			pages[lba/pageBlocks-first] = page
+			r.cache.put(lba, page)
+			data = data[pageLen:]
+			lba += pageLen / r.blocksize
+		}
+		if lba == start {
+			return fmt.Errorf("iscsi device read error: short read of %d bytes at lba %d", len(data), lba)
+		}
+	}
+	return nil
+}
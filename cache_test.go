@@ -0,0 +1,72 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestCachedReader(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	// not a whole number of pages so the last one is partial
+	size := 1*MiB + 3*512
+	fileName := writeTargetTempfile(t, rnd, int64(size))
+	expected, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err = device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sreader, err := iscsi.CachedReader(device, iscsi.CacheOptions{Size: 64 * KiB, PageBlocks: 8})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sreader.Close()
+
+	for i := 0; i < 2000; i++ {
+		off := rnd.Intn(size)
+		p := make([]byte, rnd.Intn(8*KiB)+1)
+		n, err := sreader.ReadAt(p, int64(off))
+		if err != nil && !errors.Is(err, io.EOF) {
+			t.Fatal(err)
+		}
+		want := expected[off:min(off+len(p), size)]
+		assert.Equal(t, n, len(want))
+		assert.Assert(t, bytes.Equal(p[:n], want), "mismatch reading %d bytes at %d", len(p), off)
+	}
+
+	// a repeated small read is served from the cache
+	p := make([]byte, 512)
+	_, err = sreader.ReadAt(p, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := sreader.CacheStats()
+	_, err = sreader.ReadAt(p, 4096+100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := sreader.CacheStats()
+	assert.Equal(t, after.Hits, before.Hits+1)
+	assert.Equal(t, after.Misses, before.Misses)
+	assert.Assert(t, bytes.Equal(p, expected[4096+100:4096+100+512]))
+
+	n, err := sreader.ReadAt(p, int64(size-100))
+	assert.Equal(t, n, 100)
+	assert.Assert(t, errors.Is(err, io.EOF))
+}
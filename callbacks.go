@@ -11,6 +11,21 @@ extern void iscsiChannelCB(struct iscsi_context*, int,
 extern void iscsiSyncCB(struct iscsi_context*, int,
 				 void*, void*);
 
+extern void iscsiStatusCB(struct iscsi_context*, int,
+				 void*, void*);
+
+extern void iscsiSessionCB(struct iscsi_context*, int,
+				 void*, void*);
+
+extern void iscsiDiscoveryCB(struct iscsi_context*, int,
+				 void*, void*);
+
+extern void iscsiKeepaliveCB(struct iscsi_context*, int,
+				 void*, void*);
+
+extern void iscsiTaskMgmtCB(struct iscsi_context*, int,
+				 void*, void*);
+
 void iscsiChannelCB_cgo(struct iscsi_context *iscsi, int status,
 				 void *command_data, void *private_data) {
   iscsiChannelCB(iscsi, status, command_data, private_data);
@@ -20,9 +35,44 @@ void iscsiSyncCB_cgo(struct iscsi_context *iscsi, int status,
 				 void *command_data, void *private_data) {
   iscsiSyncCB(iscsi, status, command_data, private_data);
 }
+
+void iscsiStatusCB_cgo(struct iscsi_context *iscsi, int status,
+				 void *command_data, void *private_data) {
+  iscsiStatusCB(iscsi, status, command_data, private_data);
+}
+
+void iscsiSessionCB_cgo(struct iscsi_context *iscsi, int status,
+				 void *command_data, void *private_data) {
+  iscsiSessionCB(iscsi, status, command_data, private_data);
+}
+
+void iscsiDiscoveryCB_cgo(struct iscsi_context *iscsi, int status,
+				 void *command_data, void *private_data) {
+  iscsiDiscoveryCB(iscsi, status, command_data, private_data);
+}
+
+void iscsiKeepaliveCB_cgo(struct iscsi_context *iscsi, int status,
+				 void *command_data, void *private_data) {
+  iscsiKeepaliveCB(iscsi, status, command_data, private_data);
+}
+
+void iscsiTaskMgmtCB_cgo(struct iscsi_context *iscsi, int status,
+				 void *command_data, void *private_data) {
+  iscsiTaskMgmtCB(iscsi, status, command_data, private_data);
+}
 */
 import "C"
 
 var channelCB = C.iscsi_command_cb(C.iscsiChannelCB_cgo)
 
 var syncCB = C.iscsi_command_cb(C.iscsiSyncCB_cgo)
+
+var statusCB = C.iscsi_command_cb(C.iscsiStatusCB_cgo)
+
+var sessionCB = C.iscsi_command_cb(C.iscsiSessionCB_cgo)
+
+var discoveryCB = C.iscsi_command_cb(C.iscsiDiscoveryCB_cgo)
+
+var keepaliveCB = C.iscsi_command_cb(C.iscsiKeepaliveCB_cgo)
+
+var taskMgmtCB = C.iscsi_command_cb(C.iscsiTaskMgmtCB_cgo)
@@ -10,9 +10,17 @@ import (
 )
 
 func main() {
-	if len(os.Args) != 4 {
+	if len(os.Args) != 4 && len(os.Args) != 5 {
 		panic("missing required args")
 	}
+	// "random" fills the drive with random data, "zero" wipes it
+	mode := "random"
+	if len(os.Args) == 5 {
+		mode = os.Args[4]
+	}
+	if mode != "random" && mode != "zero" {
+		panic("mode must be random or zero")
+	}
 	device := iscsi.New(iscsi.ConnectionDetails{
 		InitiatorIQN: os.Args[1],
 		TargetURL:    os.Args[2],
@@ -47,24 +55,57 @@ func main() {
 	log.Println(float64(percentage) / 100.0)
 	blocksToWrite := int(float64(float64(capacity.MaxLBA)) * float64(percentage) / 100.0)
 	log.Println(blocksToWrite)
+	if mode == "zero" {
+		// let the target do the work rather than streaming zeroes to it
+		if err := device.Zero(0, blocksToWrite); err != nil {
+			log.Fatalln(err)
+		}
+		log.Printf("zeroed %d blocks", blocksToWrite)
+		return
+	}
+	// keep a queue of writes going rather than waiting
+	// for each one to complete before sending the next
+	results := make(chan iscsi.TaskResult, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for r := range results {
+			if r.Err != nil {
+				log.Fatalln(r.Err)
+			}
+			write := r.Context.(iscsi.Write16)
+			log.Printf("wrote %d blocks starting at %d", len(write.Data)/write.BlockSize, write.LBA)
+		}
+	}()
+	// each write has to fit in a single command
+	chunkBlocks, err := device.MaxTransferBlocks(capacity.BlockSize)
+	if err != nil {
+		log.Fatalln(err)
+	}
 	currentBlock := 0
+	data := make([]byte, chunkBlocks*capacity.BlockSize)
 	for currentBlock < blocksToWrite {
-		// fixme: handle case where blocksToWrite - currentBlock < 1024
-		data := make([]byte, 1024*capacity.BlockSize)
+		blocks := min(chunkBlocks, blocksToWrite-currentBlock)
 		_, err := rand.Read(data)
 		if err != nil {
 			panic(err)
 		}
-		err = device.Write16(iscsi.Write16{
+		// the data is copied so it's fine to reuse the buffer
+		_, err = device.Write16Async(iscsi.Write16{
 			LBA:       currentBlock,
-			Data:      data,
+			Data:      data[:blocks*capacity.BlockSize],
 			BlockSize: capacity.BlockSize,
-		})
+		}, results)
 		if err != nil {
 			log.Fatalln(err)
 		}
-		log.Printf("wrote 1024 blocks starting at %d", currentBlock)
-		// write 1024 blocks at once?
-		currentBlock = currentBlock + 1024
+		currentBlock = currentBlock + blocks
+	}
+	for device.InFlight() > 0 {
+		if err := device.ProcessAsyncN(1); err != nil {
+			log.Fatalln(err)
+		}
 	}
+	close(results)
+	<-done
 }
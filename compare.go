@@ -0,0 +1,103 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"unsafe"
+)
+
+type CompareAndWrite struct {
+	LBA int
+	// Expected is what the blocks must currently contain for
+	// Data to be written.  Both must be the same whole number
+	// of blocks
+	Expected  []byte
+	Data      []byte
+	BlockSize int
+}
+
+// CompareAndWrite atomically writes Data if the blocks at LBA match
+// Expected.  If they don't, nothing is written and a *MiscompareError
+// (which matches ErrMiscompare) is returned.
+//
+// The command isn't reissued if the connection drops while it's in
+// flight since whether the write happened can't be known, instead the
+// ErrConnectionLost is returned once the session is recovered.  Nothing
+// is sent if the target's Block Limits VPD page doesn't allow the command
+func (d *device) CompareAndWrite(data CompareAndWrite) error {
+	return d.CompareAndWriteContext(context.Background(), data)
+}
+
+func (d *device) CompareAndWriteContext(ctx context.Context, data CompareAndWrite) error {
+	logger().Debug("CompareAndWrite", slog.Int("lba", data.LBA), slog.Int("bytes", len(data.Data)))
+	if data.BlockSize <= 0 || len(data.Data) == 0 || len(data.Data)%data.BlockSize != 0 {
+		return fmt.Errorf("CompareAndWrite: data must be a multiple of the %d byte block size", data.BlockSize)
+	}
+	if len(data.Expected) != len(data.Data) {
+		return errors.New("CompareAndWrite: expected and data must be the same length")
+	}
+	blocks := len(data.Data) / data.BlockSize
+	// the CDB only has a byte for the number of blocks
+	if blocks > 255 {
+		return fmt.Errorf("CompareAndWrite: %d blocks is more than a single command can carry (255)", blocks)
+	}
+	limits, err := d.cachedBlockLimits(ctx)
+	if err != nil {
+		return err
+	}
+	// a MAXIMUM COMPARE AND WRITE LENGTH of zero means the target doesn't
+	// support the command at all.  Targets without a Block Limits page
+	// haven't said either way so the command is left to them to reject
+	if !d.noBlockLimits {
+		if limits.MaxCompareAndWriteLength == 0 {
+			return errors.New("CompareAndWrite: not supported by the target")
+		}
+		if maxBlocks := limits.MaxCompareAndWriteLength; blocks > maxBlocks {
+			return fmt.Errorf("CompareAndWrite: %d blocks is more than the target allows (%d)", blocks, maxBlocks)
+		}
+	}
+
+	// the data-out buffer is the verify data followed by the write data
+	buf := make([]byte, 0, 2*len(data.Data))
+	buf = append(buf, data.Expected...)
+	buf = append(buf, data.Data...)
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	// libiscsi holds on to the buffer until the data has been sent
+	pinner.Pin(&buf[0])
+	task, err := d.runTaskOnce(ctx, "iscsi_compareandwrite_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_compareandwrite_task(d.root().Context, C.int(d.targetLun), C.uint64_t(data.LBA),
+			(*C.uchar)(unsafe.Pointer(&buf[0])), C.uint32_t(len(buf)), C.int(data.BlockSize),
+			0, 0, 0, 0, 0, cb, pdata)
+	})
+	if err != nil {
+		return compareAndWriteError(err)
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
+// compareAndWriteError turns a MISCOMPARE from the target into a
+// *MiscompareError with the offset from the sense data, and passes
+// any other error through
+func compareAndWriteError(err error) error {
+	var scsiErr *SCSIError
+	if errors.As(err, &scsiErr) && errors.Is(scsiErr, ErrMiscompare) {
+		offset := -1
+		if info, ok := scsiErr.Information(); ok {
+			offset = int(info)
+		}
+		return &MiscompareError{Offset: offset, Err: scsiErr}
+	}
+	return err
+}
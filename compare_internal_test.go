@@ -0,0 +1,43 @@
+package iscsi
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestCompareAndWriteError(t *testing.T) {
+	assert.NilError(t, compareAndWriteError(nil))
+
+	// runTaskOnce hands back the SCSIError from the task, the target
+	// puts the offset of the first mismatched byte in INFORMATION
+	miscompare := &SCSIError{
+		Op:       "iscsi_compareandwrite_task",
+		Status:   StatusCheckCondition,
+		SenseKey: SenseKeyMiscompare,
+		ASC:      0x1d,
+		Sense:    []byte{0xf0, 0, 0x0e, 0, 0, 0x02, 0x10, 10, 0, 0, 0, 0, 0x1d, 0},
+	}
+	err := compareAndWriteError(miscompare)
+	assert.Assert(t, errors.Is(err, ErrMiscompare), err)
+	var miscompareErr *MiscompareError
+	assert.Assert(t, errors.As(err, &miscompareErr), err)
+	assert.Equal(t, miscompareErr.Offset, 0x210)
+	assert.Equal(t, miscompareErr.Err, miscompare)
+
+	// without a valid INFORMATION field the offset isn't known
+	noInfo := *miscompare
+	noInfo.Sense = []byte{0x70, 0, 0x0e, 0, 0, 0x02, 0x10, 10, 0, 0, 0, 0, 0x1d, 0}
+	err = compareAndWriteError(fmt.Errorf("wrapped: %w", &noInfo))
+	assert.Assert(t, errors.As(err, &miscompareErr), err)
+	assert.Equal(t, miscompareErr.Offset, -1)
+
+	// anything else is passed through untouched
+	illegal := &SCSIError{Status: StatusCheckCondition, SenseKey: SenseKeyIllegalRequest}
+	assert.Equal(t, compareAndWriteError(illegal), error(illegal))
+	err = compareAndWriteError(ErrConnectionLost)
+	assert.Assert(t, !errors.As(err, &miscompareErr))
+	assert.Assert(t, errors.Is(err, ErrConnectionLost))
+}
@@ -0,0 +1,35 @@
+package iscsi_test
+
+import (
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestCompareAndWriteLimits(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 1*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	// more than the CDB can describe
+	data := make([]byte, 256*512)
+	err = device.CompareAndWrite(iscsi.CompareAndWrite{LBA: 0, Expected: data, Data: data, BlockSize: 512})
+	assert.ErrorContains(t, err, "more than a single command can carry")
+
+	// gotgt reports a MAXIMUM COMPARE AND WRITE LENGTH of zero
+	limits, err := device.BlockLimits()
+	assert.NilError(t, err)
+	assert.Equal(t, limits.MaxCompareAndWriteLength, 0)
+	data = make([]byte, 512)
+	err = device.CompareAndWrite(iscsi.CompareAndWrite{LBA: 0, Expected: data, Data: data, BlockSize: 512})
+	assert.ErrorContains(t, err, "not supported")
+}
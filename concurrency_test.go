@@ -84,7 +84,7 @@ func BenchmarkSingleAsyncReaderWithParallelConsumers(b *testing.B) {
 			}()
 		}
 		for i := 0; i < totalBlocks; i = i + blockChunk {
-			err := device.Read16Async(iscsi.Read16{
+			_, err := device.Read16Async(iscsi.Read16{
 				LBA:       i,
 				Blocks:    blockChunk,
 				BlockSize: 512,
@@ -265,3 +265,62 @@ func BenchmarkParallelSyncReaders(b *testing.B) {
 		w.Wait()
 	}
 }
+
+// Like BenchmarkParallelSyncReaders but all of the readers share
+// a single iscsi session
+func BenchmarkSessionParallelReaders(b *testing.B) {
+	// parameters
+	// size of the iscsi lun
+	deviceSize := 100 * MiB
+	// number of goroutines sharing the session
+	nreaders := 16
+	// block size of the lun
+	blockSize := 512
+	// how long for each consumer of the reader to wait after each read
+	consumerDelay := 100 * time.Millisecond
+
+	seed := time.Now().UnixNano()
+	b.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	fileName := writeTargetTempfile(b, rnd, int64(deviceSize))
+
+	session, err := iscsi.NewSession(context.Background(), iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(b, fileName),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	blocks := deviceSize / blockSize
+	blocksPerReader := blocks / nreaders
+	// read 1MiB at a time
+	blockChunk := MiB / blockSize
+	for i := 0; i < b.N; i++ {
+		w := sync.WaitGroup{}
+		w.Add(nreaders)
+		for start := 0; start < blocks; start = start + blocksPerReader {
+			go func() {
+				defer w.Done()
+				wtr := delayWriter{io.Discard, consumerDelay}
+				for lba := start; lba < start+blocksPerReader; lba = lba + blockChunk {
+					data, err := session.Read16(context.Background(), iscsi.Read16{
+						LBA:       lba,
+						Blocks:    min(blockChunk, start+blocksPerReader-lba),
+						BlockSize: blockSize,
+					})
+					if err != nil {
+						b.Fail()
+						b.Log("read err ", err)
+						return
+					}
+					_, _ = wtr.Write(data)
+				}
+			}()
+		}
+		w.Wait()
+	}
+}
@@ -0,0 +1,156 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include <stdlib.h>
+#include "iscsi/iscsi.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unsafe"
+
+	gopointer "github.com/mattn/go-pointer"
+)
+
+type DiscoveryDetails struct {
+	InitiatorIQN string
+	// Portal is the address of the target portal to query
+	// as host[:port]
+	Portal string
+	// CHAP credentials for the discovery session, see ConnectionDetails
+	InitiatorUsername string
+	InitiatorSecret   string
+	TargetUsername    string
+	TargetSecret      string
+}
+
+// DiscoveredTarget is a target returned by SendTargets discovery
+// along with every portal it is reachable through
+type DiscoveredTarget struct {
+	IQN     string
+	Portals []TargetPortal
+}
+
+type TargetPortal struct {
+	// Address is host:port, with IPv6 hosts in brackets
+	Address string
+	// GroupTag is the target portal group tag, or -1 if the
+	// target didn't advertise one
+	GroupTag int
+}
+
+// TargetURL returns a url for ConnectionDetails that connects to
+// lun through the first portal the target advertised
+func (t DiscoveredTarget) TargetURL(lun int) string {
+	if len(t.Portals) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("iscsi://%s/%s/%d", t.Portals[0].Address, t.IQN, lun)
+}
+
+type discoveryState struct {
+	syncCallbackState
+	targets []DiscoveredTarget
+}
+
+// Discover opens a discovery session to the portal and returns every
+// target that it reports through SendTargets
+func Discover(ctx context.Context, details DiscoveryDetails) ([]DiscoveredTarget, error) {
+	iqnStr := C.CString(details.InitiatorIQN)
+	defer C.free(unsafe.Pointer(iqnStr))
+	d := &device{details: ConnectionDetails{
+		InitiatorIQN:      details.InitiatorIQN,
+		InitiatorUsername: details.InitiatorUsername,
+		InitiatorSecret:   details.InitiatorSecret,
+		TargetUsername:    details.TargetUsername,
+		TargetSecret:      details.TargetSecret,
+	}}
+	d.Context = C.iscsi_create_context(iqnStr)
+	if d.Context == nil {
+		return nil, errors.New("unable to create iscsi context")
+	}
+	defer C.iscsi_destroy_context(d.Context)
+	_ = C.iscsi_set_session_type(d.Context, C.ISCSI_SESSION_DISCOVERY)
+	_ = C.iscsi_set_header_digest(d.Context, C.ISCSI_HEADER_DIGEST_NONE_CRC32C)
+	if err := d.setCredentials(); err != nil {
+		return nil, err
+	}
+
+	portalStr := C.CString(details.Portal)
+	defer C.free(unsafe.Pointer(portalStr))
+	if err := d.runStatus(ctx, "iscsi_connect_async", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_connect_async(d.Context, portalStr, cb, pdata)
+	}); err != nil {
+		return nil, err
+	}
+	if err := d.runStatus(ctx, "iscsi_login_async", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_login_async(d.Context, cb, pdata)
+	}); err != nil {
+		if authErr := d.authenticationError(); authErr != nil {
+			return nil, authErr
+		}
+		return nil, err
+	}
+
+	state := &discoveryState{}
+	pdata := gopointer.Save(state)
+	defer gopointer.Unref(pdata)
+	if C.iscsi_discovery_async(d.Context, discoveryCB, pdata) != 0 {
+		return nil, fmt.Errorf("unable to start iscsi_discovery_async: %s", C.GoString(C.iscsi_get_error(d.Context)))
+	}
+	if err := d.eventLoop(ctx, &state.syncCallbackState); err != nil {
+		return nil, fmt.Errorf("error while waiting for iscsi_discovery_async completion: %w", err)
+	}
+	if state.status != C.SCSI_STATUS_GOOD {
+		return nil, fmt.Errorf("iscsi_discovery_async: %s", C.GoString(C.iscsi_get_error(d.Context)))
+	}
+
+	if err := d.runStatus(ctx, "iscsi_logout_async", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_logout_async(d.Context, cb, pdata)
+	}); err != nil {
+		// we already have what we came for
+		logger().Warn("discovery logout failed", slog.Any("error", err))
+	}
+	return state.targets, nil
+}
+
+// parseTargetPortal splits a SendTargets TargetAddress value of the
+// form address[:port][,tpgt]
+func parseTargetPortal(s string) TargetPortal {
+	portal := TargetPortal{Address: s, GroupTag: -1}
+	if i := strings.LastIndex(s, ","); i >= 0 {
+		if tag, err := strconv.Atoi(s[i+1:]); err == nil {
+			portal.Address = s[:i]
+			portal.GroupTag = tag
+		}
+	}
+	return portal
+}
+
+//export iscsiDiscoveryCB
+func iscsiDiscoveryCB(_ iscsiContext, status int, command_data, private_data unsafe.Pointer) {
+	state, ok := gopointer.Restore(private_data).(*discoveryState)
+	if !ok {
+		return
+	}
+	state.status = status
+	state.finished = true
+	if status != C.SCSI_STATUS_GOOD {
+		return
+	}
+	// libiscsi frees the address list as soon as we return
+	for addr := (*C.struct_iscsi_discovery_address)(command_data); addr != nil; addr = addr.next {
+		target := DiscoveredTarget{IQN: C.GoString(addr.target_name)}
+		for portal := addr.portals; portal != nil; portal = portal.next {
+			target.Portals = append(target.Portals, parseTargetPortal(C.GoString(portal.portal)))
+		}
+		state.targets = append(state.targets, target)
+	}
+}
@@ -0,0 +1,39 @@
+package iscsi_test
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestDiscover(t *testing.T) {
+	targetURL, err := url.Parse(createAndRunTestTarget(t, 1*MiB))
+	if err != nil {
+		t.Fatal(err)
+	}
+	targets, err := iscsi.Discover(context.Background(), iscsi.DiscoveryDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		Portal:       targetURL.Host,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, len(targets), 1)
+	assert.Equal(t, targets[0].IQN, strings.Split(strings.Trim(targetURL.Path, "/"), "/")[0])
+	assert.Assert(t, len(targets[0].Portals) > 0)
+	assert.Equal(t, targets[0].Portals[0].Address, targetURL.Host)
+
+	// the discovered target can be connected to
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    targets[0].TargetURL(0),
+	})
+	if err := device.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	_ = device.Disconnect()
+}
@@ -0,0 +1,254 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"unsafe"
+)
+
+// Sentinel errors for the sense keys and statuses that callers commonly
+// need to react to.  A *SCSIError matches these with errors.Is
+var (
+	ErrNotReady            = errors.New("logical unit not ready")
+	ErrUnitAttention       = errors.New("unit attention")
+	ErrMediumError         = errors.New("medium error")
+	ErrIllegalRequest      = errors.New("illegal request")
+	ErrReservationConflict = errors.New("reservation conflict")
+	ErrDataProtect         = errors.New("data protect")
+	ErrMiscompare          = errors.New("miscompare")
+	// ErrShortTransfer is matched by a *ShortTransferError
+	ErrShortTransfer = errors.New("short transfer")
+)
+
+// SCSI status codes as reported in SCSIError.Status.  Statuses above 0xff
+// are generated by libiscsi itself rather than the target
+const (
+	StatusGood                = C.SCSI_STATUS_GOOD
+	StatusCheckCondition      = C.SCSI_STATUS_CHECK_CONDITION
+	StatusConditionMet        = C.SCSI_STATUS_CONDITION_MET
+	StatusBusy                = C.SCSI_STATUS_BUSY
+	StatusReservationConflict = C.SCSI_STATUS_RESERVATION_CONFLICT
+	StatusTaskSetFull         = C.SCSI_STATUS_TASK_SET_FULL
+	StatusACAActive           = C.SCSI_STATUS_ACA_ACTIVE
+	StatusTaskAborted         = C.SCSI_STATUS_TASK_ABORTED
+	StatusRedirect            = C.SCSI_STATUS_REDIRECT
+	StatusCancelled           = C.SCSI_STATUS_CANCELLED
+	StatusError               = C.SCSI_STATUS_ERROR
+	StatusTimeout             = C.SCSI_STATUS_TIMEOUT
+)
+
+var statusNames = map[int]string{
+	StatusGood:                "GOOD",
+	StatusCheckCondition:      "CHECK CONDITION",
+	StatusConditionMet:        "CONDITION MET",
+	StatusBusy:                "BUSY",
+	StatusReservationConflict: "RESERVATION CONFLICT",
+	StatusTaskSetFull:         "TASK SET FULL",
+	StatusACAActive:           "ACA ACTIVE",
+	StatusTaskAborted:         "TASK ABORTED",
+	StatusRedirect:            "REDIRECT",
+	StatusCancelled:           "CANCELLED",
+	StatusError:               "ERROR",
+	StatusTimeout:             "TIMEOUT",
+}
+
+// SenseKey is the sense key the target reports alongside a
+// CHECK CONDITION status
+type SenseKey int
+
+const (
+	SenseKeyNoSense        SenseKey = C.SCSI_SENSE_NO_SENSE
+	SenseKeyRecoveredError SenseKey = C.SCSI_SENSE_RECOVERED_ERROR
+	SenseKeyNotReady       SenseKey = C.SCSI_SENSE_NOT_READY
+	SenseKeyMediumError    SenseKey = C.SCSI_SENSE_MEDIUM_ERROR
+	SenseKeyHardwareError  SenseKey = C.SCSI_SENSE_HARDWARE_ERROR
+	SenseKeyIllegalRequest SenseKey = C.SCSI_SENSE_ILLEGAL_REQUEST
+	SenseKeyUnitAttention  SenseKey = C.SCSI_SENSE_UNIT_ATTENTION
+	SenseKeyDataProtect    SenseKey = C.SCSI_SENSE_DATA_PROTECTION
+	SenseKeyBlankCheck     SenseKey = C.SCSI_SENSE_BLANK_CHECK
+	SenseKeyVendorSpecific SenseKey = C.SCSI_SENSE_VENDOR_SPECIFIC
+	SenseKeyCopyAborted    SenseKey = C.SCSI_SENSE_COPY_ABORTED
+	SenseKeyAbortedCommand SenseKey = C.SCSI_SENSE_COMMAND_ABORTED
+	SenseKeyVolumeOverflow SenseKey = C.SCSI_SENSE_OVERFLOW_COMMAND
+	SenseKeyMiscompare     SenseKey = C.SCSI_SENSE_MISCOMPARE
+)
+
+func (k SenseKey) String() string {
+	return C.GoString(C.scsi_sense_key_str(C.int(k)))
+}
+
+// SCSIError is returned when a command completes with a status
+// other than GOOD
+type SCSIError struct {
+	// Op is the libiscsi call that issued the command
+	Op     string
+	Status int
+	// SenseKey, ASC and ASCQ are only meaningful when Status
+	// is StatusCheckCondition
+	SenseKey SenseKey
+	ASC      uint8
+	ASCQ     uint8
+	// Description is a human readable decoding of the status
+	// and sense data
+	Description string
+	// CDB is the command descriptor block of the failed command
+	CDB []byte
+	// Sense is the raw sense data, if the target sent any
+	Sense []byte
+}
+
+func (e *SCSIError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Op, e.Description)
+}
+
+func (e *SCSIError) Is(target error) bool {
+	switch target {
+	case ErrReservationConflict:
+		return e.Status == StatusReservationConflict
+	case ErrNotReady:
+		return e.checkCondition(SenseKeyNotReady)
+	case ErrUnitAttention:
+		return e.checkCondition(SenseKeyUnitAttention)
+	case ErrMediumError:
+		return e.checkCondition(SenseKeyMediumError)
+	case ErrIllegalRequest:
+		return e.checkCondition(SenseKeyIllegalRequest)
+	case ErrDataProtect:
+		return e.checkCondition(SenseKeyDataProtect)
+	case ErrMiscompare:
+		return e.checkCondition(SenseKeyMiscompare)
+	}
+	return false
+}
+
+func (e *SCSIError) checkCondition(key SenseKey) bool {
+	return e.Status == StatusCheckCondition && e.SenseKey == key
+}
+
+// newSCSIError decodes the status and sense data of a completed task.
+// iscsiCtx is used to pick up libiscsi's own description of errors that
+// didn't come from the target, and task may be nil if libiscsi never
+// passed one back
+func newSCSIError(op string, iscsiCtx iscsiContext, status int, task *C.struct_scsi_task) *SCSIError {
+	e := &SCSIError{
+		Op:     op,
+		Status: status,
+	}
+	if task != nil {
+		e.CDB = C.GoBytes(unsafe.Pointer(&task.cdb[0]), task.cdb_size)
+	}
+	name, ok := statusNames[status]
+	if !ok {
+		name = fmt.Sprintf("status 0x%x", status)
+	}
+	switch {
+	case status == StatusCheckCondition && task != nil:
+		// libiscsi leaves the sense data, after its 2 byte length,
+		// in the data-in buffer
+		if task.datain.data != nil && task.datain.size > 2 {
+			raw := C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size)
+			senseLen := int(binary.BigEndian.Uint16(raw[:2]))
+			e.Sense = raw[2:min(2+senseLen, len(raw))]
+		}
+		e.SenseKey = SenseKey(task.sense.key)
+		e.ASC = uint8(task.sense.ascq >> 8)
+		e.ASCQ = uint8(task.sense.ascq)
+		e.Description = fmt.Sprintf("%s: %s (0x%02x/0x%02x): %s", name, e.SenseKey,
+			e.ASC, e.ASCQ, C.GoString(C.scsi_sense_ascq_str(task.sense.ascq)))
+	case status > 0xff:
+		e.Description = fmt.Sprintf("%s: %s", name, C.GoString(C.iscsi_get_error(iscsiCtx)))
+	default:
+		e.Description = name
+	}
+	return e
+}
+
+// Information returns the INFORMATION field of the sense data, which
+// depending on the command is an lba or byte offset related to the error
+func (e *SCSIError) Information() (uint64, bool) {
+	return senseInformation(e.Sense)
+}
+
+func senseInformation(sense []byte) (uint64, bool) {
+	if len(sense) == 0 {
+		return 0, false
+	}
+	switch sense[0] & 0x7f {
+	case 0x70, 0x71:
+		// fixed format, only valid if the VALID bit is set
+		if len(sense) < 7 || sense[0]&0x80 == 0 {
+			return 0, false
+		}
+		return uint64(binary.BigEndian.Uint32(sense[3:7])), true
+	case 0x72, 0x73:
+		// descriptor format, look for an information descriptor
+		for off := 8; off+2 <= len(sense); off += 2 + int(sense[off+1]) {
+			if sense[off] == 0x00 && off+12 <= len(sense) && sense[off+2]&0x80 != 0 {
+				return binary.BigEndian.Uint64(sense[off+4 : off+12]), true
+			}
+		}
+	}
+	return 0, false
+}
+
+// MiscompareError is returned by CompareAndWrite when the data on the
+// LUN didn't match what was expected
+type MiscompareError struct {
+	// Offset is the offset in bytes into the expected data of the first
+	// byte that didn't match, or -1 if the target didn't say
+	Offset int
+	Err    *SCSIError
+}
+
+func (e *MiscompareError) Error() string {
+	if e.Offset < 0 {
+		return e.Err.Error()
+	}
+	return fmt.Sprintf("%s (at offset %d)", e.Err, e.Offset)
+}
+
+func (e *MiscompareError) Unwrap() error {
+	return e.Err
+}
+
+// ShortTransferError is returned when the target completes a command
+// successfully but transfers less data than was asked for
+type ShortTransferError struct {
+	Op string
+	// Expected and Transferred are in bytes
+	Expected    int
+	Transferred int
+}
+
+func (e *ShortTransferError) Error() string {
+	return fmt.Sprintf("%s: short transfer: got %d of %d bytes", e.Op, e.Transferred, e.Expected)
+}
+
+func (e *ShortTransferError) Is(target error) bool {
+	return target == ErrShortTransfer
+}
+
+// dataIn returns the data the target sent for a task that expected
+// want bytes, using the residual to catch targets that came up short
+func dataIn(task *C.struct_scsi_task, want int) []byte {
+	n := int(task.datain.size)
+	switch task.residual_status {
+	case C.SCSI_RESIDUAL_UNDERFLOW:
+		logger().Debug("data-in underflow", slog.Int("expected", want), slog.Int("residual", int(task.residual)))
+		n = min(n, want-int(task.residual))
+	case C.SCSI_RESIDUAL_OVERFLOW:
+		// the target had more to send than we asked for, which we
+		// can only ignore
+		logger().Debug("data-in overflow", slog.Int("expected", want), slog.Int("residual", int(task.residual)))
+	}
+	return C.GoBytes(unsafe.Pointer(task.datain.data), C.int(max(min(n, want), 0)))
+}
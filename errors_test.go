@@ -0,0 +1,123 @@
+package iscsi_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestSCSIErrorIs(t *testing.T) {
+	testCases := []struct {
+		desc     string
+		err      *iscsi.SCSIError
+		expected error
+	}{
+		{
+			desc:     "unit attention",
+			err:      &iscsi.SCSIError{Status: iscsi.StatusCheckCondition, SenseKey: iscsi.SenseKeyUnitAttention},
+			expected: iscsi.ErrUnitAttention,
+		},
+		{
+			desc:     "medium error",
+			err:      &iscsi.SCSIError{Status: iscsi.StatusCheckCondition, SenseKey: iscsi.SenseKeyMediumError},
+			expected: iscsi.ErrMediumError,
+		},
+		{
+			desc:     "not ready",
+			err:      &iscsi.SCSIError{Status: iscsi.StatusCheckCondition, SenseKey: iscsi.SenseKeyNotReady},
+			expected: iscsi.ErrNotReady,
+		},
+		{
+			desc:     "illegal request",
+			err:      &iscsi.SCSIError{Status: iscsi.StatusCheckCondition, SenseKey: iscsi.SenseKeyIllegalRequest},
+			expected: iscsi.ErrIllegalRequest,
+		},
+		{
+			desc:     "data protect",
+			err:      &iscsi.SCSIError{Status: iscsi.StatusCheckCondition, SenseKey: iscsi.SenseKeyDataProtect},
+			expected: iscsi.ErrDataProtect,
+		},
+		{
+			desc:     "miscompare",
+			err:      &iscsi.SCSIError{Status: iscsi.StatusCheckCondition, SenseKey: iscsi.SenseKeyMiscompare},
+			expected: iscsi.ErrMiscompare,
+		},
+		{
+			desc:     "reservation conflict",
+			err:      &iscsi.SCSIError{Status: iscsi.StatusReservationConflict},
+			expected: iscsi.ErrReservationConflict,
+		},
+	}
+	sentinels := []error{
+		iscsi.ErrNotReady, iscsi.ErrUnitAttention, iscsi.ErrMediumError,
+		iscsi.ErrIllegalRequest, iscsi.ErrReservationConflict, iscsi.ErrDataProtect,
+		iscsi.ErrMiscompare,
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			wrapped := fmt.Errorf("wrapped: %w", tC.err)
+			for _, sentinel := range sentinels {
+				assert.Equal(t, errors.Is(wrapped, sentinel), sentinel == tC.expected, sentinel)
+			}
+			var scsiErr *iscsi.SCSIError
+			assert.Assert(t, errors.As(wrapped, &scsiErr))
+			assert.Equal(t, scsiErr.SenseKey, tC.err.SenseKey)
+		})
+	}
+}
+
+func TestShortTransferError(t *testing.T) {
+	err := fmt.Errorf("wrapped: %w", &iscsi.ShortTransferError{Op: "iscsi_read16_task", Expected: 4096, Transferred: 1024})
+	assert.Assert(t, errors.Is(err, iscsi.ErrShortTransfer))
+	assert.Assert(t, !errors.Is(err, iscsi.ErrMediumError))
+	var shortErr *iscsi.ShortTransferError
+	assert.Assert(t, errors.As(err, &shortErr))
+	assert.Equal(t, shortErr.Transferred, 1024)
+}
+
+// gotgt doesn't actually compare for COMPARE AND WRITE so the miscompare
+// path can only be checked with made up sense data
+func TestMiscompareError(t *testing.T) {
+	testCases := []struct {
+		desc   string
+		sense  []byte
+		offset uint64
+		ok     bool
+	}{
+		{
+			desc:   "fixed format",
+			sense:  []byte{0xf0, 0, 0x0e, 0, 0, 0x02, 0x10, 10, 0, 0, 0, 0, 0x1d, 0},
+			offset: 0x210,
+			ok:     true,
+		},
+		{
+			desc:  "fixed format not valid",
+			sense: []byte{0x70, 0, 0x0e, 0, 0, 0x02, 0x10, 10, 0, 0, 0, 0, 0x1d, 0},
+		},
+		{
+			desc: "descriptor format",
+			sense: []byte{0x72, 0x0e, 0x1d, 0, 0, 0, 0, 12,
+				0x00, 0x0a, 0x80, 0, 0, 0, 0, 0, 0, 0, 0x01, 0xff},
+			offset: 0x1ff,
+			ok:     true,
+		},
+		{desc: "no sense"},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			scsiErr := &iscsi.SCSIError{Status: iscsi.StatusCheckCondition, SenseKey: iscsi.SenseKeyMiscompare, Sense: tC.sense}
+			offset, ok := scsiErr.Information()
+			assert.Equal(t, ok, tC.ok)
+			assert.Equal(t, offset, tC.offset)
+
+			err := fmt.Errorf("wrapped: %w", &iscsi.MiscompareError{Offset: int(offset), Err: scsiErr})
+			assert.Assert(t, errors.Is(err, iscsi.ErrMiscompare))
+			var miscompare *iscsi.MiscompareError
+			assert.Assert(t, errors.As(err, &miscompare))
+			assert.Equal(t, miscompare.Offset, int(tC.offset))
+		})
+	}
+}
@@ -14,8 +14,10 @@ import (
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"math"
+	"strings"
+	"sync"
 	"sync/atomic"
 	"syscall"
 	"time"
@@ -48,30 +50,104 @@ type (
 )
 
 type device struct {
+	// Context is nil for LUN handles, use root().Context
 	Context      iscsiContext
 	targetName   string
 	targetPortal string
 	targetLun    int
 	details      ConnectionDetails
-	// TODO: (willgorman) iscsiContext has a timeout (set with iscsi_set_timeout)
-	// but it's not exported and there's no get function. need to track timeout in
-	// device
+	// parent is set on handles created with LUN, which share
+	// the parent's logged in session rather than owning one
+	parent *device
+	// set once the target has rejected WRITE SAME with NDOB
+	noWriteSameNDOB bool
+	// the Block Limits VPD page, fetched the first time it's needed.
+	// It's all zeroes if the target doesn't have the page, in which
+	// case noBlockLimits is set
+	blockLimits   *BlockLimits
+	noBlockLimits bool
+	// set once the target has rejected READ CAPACITY(16)
+	noReadCapacity16 bool
+	// how many async commands are waiting on a callback, and
+	// their handles
+	inFlight int
+	pending  map[*TaskHandle]struct{}
+	// connMu is held while the caller is using Context so that the
+	// keepalive goroutine only touches the connection when it's idle.
+	// LUN handles use their parent's
+	connMu sync.Mutex
+	// keepalive is set while keepalives are enabled on the session
+	keepalive *keepalive
+	// set when a Session's event loop services the connection, in
+	// which case it sends the keepalives itself
+	loopOwned bool
 }
 
 type ConnectionDetails struct {
 	InitiatorIQN string
 	TargetURL    string
-}
+	// InitiatorUsername and InitiatorSecret are the CHAP credentials
+	// the initiator authenticates to the target with.  They take
+	// precedence over any credentials in the TargetURL userinfo
+	InitiatorUsername string
+	InitiatorSecret   string
+	// TargetUsername and TargetSecret are the credentials the target
+	// must authenticate back with for mutual CHAP.  Leave them empty
+	// for one way CHAP
+	TargetUsername string
+	TargetSecret   string
+	// RetryPolicy controls how logins are retried, both in Connect and
+	// when recovering a dropped session
+	RetryPolicy RetryPolicy
+	// DisableRecovery turns off automatically reconnecting when a
+	// command fails because the connection to the target was lost
+	DisableRecovery bool
+	// OnRecovery, if set, is called after each attempt to recover a lost
+	// session with the error that triggered it and the outcome
+	OnRecovery func(cause, err error)
+	// MaxInFlight is how many async commands (Read16Async,
+	// Write16Async, ...), or commands from a Session's callers, may be
+	// queued on the connection before starting another waits for one
+	// to complete.  Defaults to 32
+	MaxInFlight int
+	// Keepalive periodically checks that the target is still there
+	// while the session is idle, see KeepaliveOptions
+	Keepalive KeepaliveOptions
+	// HeaderDigest and DataDigest choose which digests are offered
+	// at login
+	HeaderDigest Digest
+	DataDigest   Digest
+	// ImmediateData and InitialR2T override libiscsi's offer for
+	// these login keys.  The target may still turn them down, with
+	// ImmediateData only used if both sides say yes and InitialR2T
+	// used if either does
+	ImmediateData LoginOption
+	InitialR2T    LoginOption
+}
+
+// ErrAuthenticationFailed is returned from Connect when the target
+// rejects the initiator's credentials, or the target fails to prove
+// its own identity with mutual CHAP
+var ErrAuthenticationFailed = errors.New("iscsi authentication failed")
 
 // Creates a new ISCSI device with the given connection details
 // Note that an ISCSI device is not safe to use from multiple
-// goroutines
+// goroutines, see NewSession for that
 func New(details ConnectionDetails) *device {
 	return &device{
 		details: details,
 	}
 }
 
+// root returns the device that owns the session, which for
+// LUN handles is the device they were opened from
+func (d *device) root() *device {
+	if d.parent != nil {
+		return d.parent
+	}
+	return d
+}
+
 func (d *device) initializeContext() error {
 	if d.Context != nil {
 		_ = C.iscsi_destroy_context(d.Context)
@@ -98,39 +174,133 @@ func (d *device) initializeContext() error {
 	d.targetName = C.GoString(&url.target[0])
 	d.targetPortal = C.GoString(&url.portal[0])
 	_ = C.iscsi_set_session_type(d.Context, C.ISCSI_SESSION_NORMAL)
-	_ = C.iscsi_set_header_digest(d.Context, C.ISCSI_HEADER_DIGEST_NONE_CRC32C)
+	if err := d.setLoginOptions(); err != nil {
+		return err
+	}
+	return d.setCredentials()
+}
+
+func (d *device) setCredentials() error {
+	if d.details.InitiatorUsername != "" {
+		user := C.CString(d.details.InitiatorUsername)
+		defer C.free(unsafe.Pointer(user))
+		secret := C.CString(d.details.InitiatorSecret)
+		defer C.free(unsafe.Pointer(secret))
+		if C.iscsi_set_initiator_username_pwd(d.Context, user, secret) != 0 {
+			return fmt.Errorf("error setting initiator credentials: %s", C.GoString(C.iscsi_get_error(d.Context)))
+		}
+	}
+	if d.details.TargetUsername != "" {
+		if d.details.InitiatorUsername == "" {
+			return errors.New("mutual CHAP requires initiator credentials as well")
+		}
+		user := C.CString(d.details.TargetUsername)
+		defer C.free(unsafe.Pointer(user))
+		secret := C.CString(d.details.TargetSecret)
+		defer C.free(unsafe.Pointer(secret))
+		if C.iscsi_set_target_username_pwd(d.Context, user, secret) != 0 {
+			return fmt.Errorf("error setting target credentials: %s", C.GoString(C.iscsi_get_error(d.Context)))
+		}
+	}
+	return nil
+}
+
+// authenticationError checks whether the last login failed because of
+// credentials, which no amount of retrying will fix
+func (d *device) authenticationError() error {
+	return authenticationFailure(C.GoString(C.iscsi_get_error(d.Context)))
+}
+
+// authenticationFailure matches the libiscsi error string msg against the
+// login failures caused by credentials.  libiscsi only reports these
+// through its error string
+func authenticationFailure(msg string) error {
+	for _, reason := range []string{"Authentication failure", "Authorization failure", "CHAP"} {
+		if strings.Contains(msg, reason) {
+			return fmt.Errorf("%w: %s", ErrAuthenticationFailed, msg)
+		}
+	}
 	return nil
 }
 
+// loginError is what a retried login returns after failing with err,
+// which stops the retries if the credentials were rejected
+func loginError(err, authErr error) error {
+	if authErr != nil {
+		return retry.Unrecoverable(authErr)
+	}
+	return err
+}
+
 func (d *device) Connect() error {
+	return d.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect but gives up retrying, and abandons any
+// connection attempt in progress, once ctx is done
+func (d *device) ConnectContext(ctx context.Context) error {
+	if d.parent != nil {
+		return errLUNHandle
+	}
+	d.stopKeepalive()
+	d.releaseKeepalive()
 	if err := d.initializeContext(); err != nil {
 		return err
 	}
-	return retry.Do(func() error {
-		portalStr := C.CString(d.targetPortal)
-		defer C.free(unsafe.Pointer(portalStr))
-		if retval := C.iscsi_full_connect_sync(d.Context, portalStr, C.int(d.targetLun)); retval != 0 {
-			errstr := C.iscsi_get_error(d.Context)
+	err := retry.Do(func() error {
+		if err := d.fullConnect(ctx); err != nil {
+			err = loginError(err, d.authenticationError())
 			// reset the context before retrying.  it seems like some connection
 			// errors leave the context in an inconsistent state that makes it
 			// difficult to reuse
 			d.initializeContext()
-			return fmt.Errorf("iscsi_full_connect_sync: (%d) %s", retval, C.GoString(errstr))
+			return err
 		}
 		return nil
-	}, retry.Attempts(20), retry.MaxDelay(500*time.Millisecond))
+	}, d.details.RetryPolicy.options(ctx)...)
+	if err != nil {
+		return err
+	}
+	d.startKeepalive()
+	return nil
 }
 
+func (d *device) fullConnect(ctx context.Context) error {
+	portalStr := C.CString(d.targetPortal)
+	defer C.free(unsafe.Pointer(portalStr))
+	return d.runStatus(ctx, "iscsi_full_connect_async", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_full_connect_async(d.Context, portalStr, C.int(d.targetLun), cb, pdata)
+	})
+}
+
+// Reconnect logs in to the target again over a new connection, retrying
+// according to the device's RetryPolicy.  Commands that were queued on
+// the old connection are reissued on the new one
 func (d *device) Reconnect() error {
-	if retval := C.iscsi_reconnect_sync(d.Context); retval != 0 {
-		if retval != 0 {
-			return fmt.Errorf("failed to reconnect with: %d", retval)
-		}
+	return d.ReconnectContext(context.Background())
+}
+
+func (d *device) ReconnectContext(ctx context.Context) error {
+	if d.parent != nil {
+		return errLUNHandle
 	}
-	return nil
+	return retry.Do(func() error {
+		if err := d.reconnect(ctx); err != nil {
+			return loginError(err, d.authenticationError())
+		}
+		return nil
+	}, d.details.RetryPolicy.options(ctx)...)
 }
 
+// Disconnect logs out and releases the session.  For handles
+// created with LUN this does nothing, the session stays open
+// until the device it came from is disconnected
 func (d *device) Disconnect() error {
+	if d.parent != nil {
+		return nil
+	}
+	d.stopKeepalive()
+	defer d.releaseKeepalive()
 	defer C.iscsi_destroy_context(d.Context)
 	retval := C.iscsi_logout_sync(d.Context)
 	if retval != 0 {
@@ -143,46 +313,117 @@ type Capacity struct {
 	// the maximum addressable block in the device
 	MaxLBA    int
 	BlockSize int
+	// the remaining fields are only reported by READ CAPACITY(16) and
+	// are zero when the capacity came from READ CAPACITY(10)
+
+	// PhysicalBlockSize is the size of the blocks the medium actually
+	// writes, writes that aren't aligned to it will be slower
+	PhysicalBlockSize int
+	// LowestAlignedLBA is the first logical block that starts
+	// a physical block
+	LowestAlignedLBA int
+	// ThinProvisioned is set when the LUN supports logical block
+	// provisioning management, i.e. UNMAP
+	ThinProvisioned bool
+	// ReadZeros is set when unmapped blocks read back as zeroes
+	ReadZeros bool
+	// ProtectionType is the T10-PI protection type (1-3), or 0 when
+	// protection information is disabled
+	ProtectionType int
+	// ProtectionIntervalExponent is log2 of the number of protection
+	// information intervals per logical block
+	ProtectionIntervalExponent int
+}
+
+func capacity10(rc C.struct_scsi_readcapacity10) Capacity {
+	return Capacity{
+		MaxLBA:    int(rc.lba),
+		BlockSize: int(rc.block_size),
+	}
+}
+
+func capacity16(rc C.struct_scsi_readcapacity16) Capacity {
+	c := Capacity{
+		MaxLBA:                     int(rc.returned_lba),
+		BlockSize:                  int(rc.block_length),
+		PhysicalBlockSize:          int(rc.block_length) << rc.lbppbe,
+		LowestAlignedLBA:           int(rc.lalba),
+		ThinProvisioned:            rc.lbpme != 0,
+		ReadZeros:                  rc.lbprz != 0,
+		ProtectionIntervalExponent: int(rc.p_i_exp),
+	}
+	if rc.prot_en != 0 {
+		// P_TYPE 0 is type 1 protection
+		c.ProtectionType = int(rc.p_type) + 1
+	}
+	return c
+}
+
+// ReadCapacity uses READ CAPACITY(16), falling back to READ CAPACITY(10)
+// for targets that don't support it
+func (d *device) ReadCapacity() (c Capacity, err error) {
+	return d.ReadCapacityContext(context.Background())
+}
+
+func (d *device) ReadCapacityContext(ctx context.Context) (c Capacity, err error) {
+	if !d.noReadCapacity16 {
+		c, err = d.ReadCapacity16Context(ctx)
+		if !errors.Is(err, ErrIllegalRequest) {
+			return c, err
+		}
+		logger().Debug("READ CAPACITY(16) not supported, falling back to READ CAPACITY(10)")
+		d.noReadCapacity16 = true
+	}
+	c, err = d.ReadCapacity10Context(ctx)
+	if err != nil {
+		return c, err
+	}
+	if int64(c.MaxLBA) == math.MaxUint32 {
+		// the LUN is too big for READ CAPACITY(10) to describe so
+		// there's no choice but READ CAPACITY(16)
+		return d.ReadCapacity16Context(ctx)
+	}
+	return c, nil
 }
 
-func (d device) ReadCapacity10() (c Capacity, err error) {
-	task := C.iscsi_readcapacity10_sync(d.Context, 0, 0, 0)
-	defer func() {
-		if task != nil {
-			C.scsi_free_scsi_task(task)
-		}
-	}()
-	if task == nil || task.status != C.SCSI_STATUS_GOOD {
-		errstr := C.iscsi_get_error(d.Context)
-		return c, fmt.Errorf("iscsi_readcapacity10_sync: %s", C.GoString(errstr))
+func (d *device) ReadCapacity10() (c Capacity, err error) {
+	return d.ReadCapacity10Context(context.Background())
+}
+
+func (d *device) ReadCapacity10Context(ctx context.Context) (c Capacity, err error) {
+	task, err := d.runIdempotentTask(ctx, "iscsi_readcapacity10_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_readcapacity10_task(d.root().Context, C.int(d.targetLun), 0, 0, cb, pdata)
+	})
+	if err != nil {
+		return c, err
 	}
+	defer C.scsi_free_scsi_task(task)
 	readcapacity, err := getReadCapacity10(*task)
 	if err != nil {
 		return c, err
 	}
-	c.BlockSize = int(readcapacity.block_size)
-	c.MaxLBA = int(readcapacity.lba)
+	c = capacity10(readcapacity)
 	logger().Debug("ReadCapacity10", slog.Any("capacity", c))
 	return c, nil
 }
 
-func (d device) ReadCapacity16() (c Capacity, err error) {
-	task := C.iscsi_readcapacity16_sync(d.Context, 0)
-	defer func() {
-		if task != nil {
-			C.scsi_free_scsi_task(task)
-		}
-	}()
-	if task == nil || task.status != C.SCSI_STATUS_GOOD {
-		errstr := C.iscsi_get_error(d.Context)
-		return c, fmt.Errorf("iscsi_readcapacity16_sync: %s", C.GoString(errstr))
+func (d *device) ReadCapacity16() (c Capacity, err error) {
+	return d.ReadCapacity16Context(context.Background())
+}
+
+func (d *device) ReadCapacity16Context(ctx context.Context) (c Capacity, err error) {
+	task, err := d.runIdempotentTask(ctx, "iscsi_readcapacity16_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_readcapacity16_task(d.root().Context, C.int(d.targetLun), cb, pdata)
+	})
+	if err != nil {
+		return c, err
 	}
+	defer C.scsi_free_scsi_task(task)
 	readcapacity, err := getReadCapacity16(*task)
 	if err != nil {
 		return c, err
 	}
-	c.BlockSize = int(readcapacity.block_length)
-	c.MaxLBA = int(readcapacity.returned_lba)
+	c = capacity16(readcapacity)
 	logger().Debug("ReadCapacity16", slog.Any("capacity", c))
 	return c, nil
 }
@@ -191,43 +432,53 @@ type Write16 struct {
 	LBA       int
 	Data      []byte
 	BlockSize int
+	// FUA (force unit access) makes the target write the data to
+	// stable storage before completing the command, rather than
+	// leaving it in a volatile write cache
+	FUA bool
 }
 
 func (d *device) Write16(data Write16) error {
-	logger().Debug("Write16", slog.Any("request", data))
-	state := &syncCallbackState{}
-	pdata := gopointer.Save(state)
-	defer gopointer.Unref(pdata)
-	carr := []C.uchar(string(data.Data))
-	// TODO: (willgorman) figure out why larger blocksizes cause SCSI_SENSE_ASCQ_INVALID_FIELD_IN_INFORMATION_UNIT
-	if C.iscsi_write16_task(
-		d.Context, 0, C.uint64_t(data.LBA), &carr[0], C.uint(len(carr)),
-		C.int(data.BlockSize), 0, 0, 0, 0, 0, syncCB, pdata,
-	) == nil {
-		return errors.New("unable to start iscsi_write16_task")
-	}
+	return d.Write16Context(context.Background(), data)
+}
 
-	if err := d.eventLoop(state); err != nil {
-		return fmt.Errorf("error while waiting for task completion: %w", err)
+func (d *device) Write16Context(ctx context.Context, data Write16) error {
+	logger().Debug("Write16", slog.Any("request", data))
+	if data.BlockSize <= 0 || len(data.Data)%data.BlockSize != 0 {
+		return fmt.Errorf("Write16: data must be a multiple of the %d byte block size", data.BlockSize)
 	}
-	task := state.scsiTask
-	if task != nil {
-		defer C.scsi_free_scsi_task(task)
+	maxBlocks, err := d.maxTransferBlocks(ctx, data.BlockSize)
+	if err != nil {
+		return err
 	}
-	if task == nil || task.status != C.SCSI_STATUS_GOOD {
-		// TODO: (willgorman) robust error checking of condition, sense key, etc
-		// from libiscsi
-		// ok = task->status == SCSI_STATUS_GOOD ||
-		// (task->status == SCSI_STATUS_CHECK_CONDITION &&
-		//  task->sense.key == SCSI_SENSE_ILLEGAL_REQUEST &&
-		//  task->sense.ascq == SCSI_SENSE_ASCQ_INVALID_FIELD_IN_INFORMATION_UNIT);
-		errstr := C.iscsi_get_error(d.Context)
-		return fmt.Errorf("iscsi_write16_sync: %s", C.GoString(errstr))
+	chunk := maxBlocks * data.BlockSize
+	for off := 0; off < len(data.Data); off += chunk {
+		end := min(off+chunk, len(data.Data))
+		if err := d.write16(ctx, data.LBA+off/data.BlockSize, data.Data[off:end], data.BlockSize, data.FUA); err != nil {
+			return err
+		}
 	}
 	logger().Debug("Write16 done", slog.Any("request", data))
 	return nil
 }
 
+// write16 sends a single WRITE(16) that fits within the target's
+// transfer limits
+func (d *device) write16(ctx context.Context, lba int, data []byte, blockSize int, fua bool) error {
+	carr := []C.uchar(string(data))
+	task, err := d.runIdempotentTask(ctx, "iscsi_write16_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_write16_task(
+			d.root().Context, C.int(d.targetLun), C.uint64_t(lba), &carr[0], C.uint(len(carr)),
+			C.int(blockSize), 0, 0, cBool(fua), 0, 0, cb, pdata,
+		)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
 type Read16 struct {
 	LBA       int
 	Blocks    int
@@ -235,56 +486,238 @@ type Read16 struct {
 }
 
 func (d *device) Read16(data Read16) ([]byte, error) {
+	return d.Read16Context(context.Background(), data)
+}
+
+func (d *device) Read16Context(ctx context.Context, data Read16) ([]byte, error) {
+	maxBlocks, err := d.maxTransferBlocks(ctx, data.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	if data.Blocks <= maxBlocks {
+		return d.read16(ctx, data.LBA, data.Blocks, data.BlockSize)
+	}
+	return readChunked(data.Blocks, data.BlockSize, maxBlocks, func(done, blocks int) ([]byte, error) {
+		return d.read16(ctx, data.LBA+done, blocks, data.BlockSize)
+	})
+}
+
+// readChunked splits a read of blocks into reads of at most maxBlocks,
+// calling read with how many blocks are already done and how many to
+// read next.  If one comes up short the data so far is returned along
+// with a ShortTransferError that covers the whole read
+func readChunked(blocks, blockSize, maxBlocks int, read func(done, blocks int) ([]byte, error)) ([]byte, error) {
+	dataIn := make([]byte, 0, blocks*blockSize)
+	for done := 0; done < blocks; done += maxBlocks {
+		chunk, err := read(done, min(maxBlocks, blocks-done))
+		var short *ShortTransferError
+		if errors.As(err, &short) {
+			dataIn = append(dataIn, chunk...)
+			return dataIn, &ShortTransferError{Op: short.Op, Expected: blocks * blockSize, Transferred: len(dataIn)}
+		}
+		if err != nil {
+			return nil, err
+		}
+		dataIn = append(dataIn, chunk...)
+	}
+	return dataIn, nil
+}
+
+// read16 reads blocks that fit within the target's transfer limits,
+// asking again for anything the target leaves out of its response
+func (d *device) read16(ctx context.Context, lba, blocks, blockSize int) ([]byte, error) {
+	want := blocks * blockSize
+	data, err := d.read16Task(ctx, lba, blocks, blockSize)
+	for err == nil && len(data) < want {
+		got := len(data) / blockSize
+		data = data[:got*blockSize]
+		var more []byte
+		more, err = d.read16Task(ctx, lba+got, blocks-got, blockSize)
+		if err == nil && len(more) < blockSize {
+			// no progress, give up rather than loop forever
+			return data, &ShortTransferError{Op: "iscsi_read16_task", Expected: want, Transferred: len(data)}
+		}
+		data = append(data, more...)
+	}
+	return data, err
+}
+
+func (d *device) read16Task(ctx context.Context, lba, blocks, blockSize int) ([]byte, error) {
+	task, err := d.runIdempotentTask(ctx, "iscsi_read16_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_read16_task(
+			d.root().Context, C.int(d.targetLun), C.uint64_t(lba),
+			C.uint(blockSize*blocks), C.int(blockSize),
+			0, 0, 0, 0, 0, cb, pdata,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.scsi_free_scsi_task(task)
+	logger().Debug("Read16 done", slog.Any("length", task.datain.size))
+	return dataIn(task, blockSize*blocks), nil
+}
+
+func (d *device) Read16Async(data Read16, tasks chan TaskResult) (*TaskHandle, error) {
+	// the read request is the result's context so the consumer can
+	// tell what lba the read started at
+	return d.startAsync("iscsi_read16_task", data, tasks, nil,
+		func(cb C.iscsi_command_cb, pdata unsafe.Pointer, _ *C.uchar) *C.struct_scsi_task {
+			return C.iscsi_read16_task(d.root().Context, C.int(d.targetLun), C.uint64_t(data.LBA),
+				C.uint(data.BlockSize*data.Blocks), C.int(data.BlockSize), 0, 0, 0, 0, 0, cb, pdata)
+		})
+}
+
+// how long to wait for the target to answer an ABORT TASK request
+// before giving up and cancelling the task locally anyway
+const abortTimeout = 5 * time.Second
+
+// runTask starts a scsi task with the given callback and private data
+// and services the connection until the task completes or ctx is done.
+// If ctx is done first the task is aborted on the target, cancelled
+// locally and an error wrapping ctx.Err() is returned.  On success the
+// caller owns the returned task and must free it with scsi_free_scsi_task
+func (d *device) runTask(ctx context.Context, name string, start func(C.iscsi_command_cb, unsafe.Pointer) *C.struct_scsi_task) (*C.struct_scsi_task, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	if err := d.keepaliveErr(); err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	root := d.root()
+	root.connMu.Lock()
+	defer root.connMu.Unlock()
 	state := &syncCallbackState{}
 	pdata := gopointer.Save(state)
 	defer gopointer.Unref(pdata)
 
-	if C.iscsi_read16_task(
-		d.Context, 0, C.uint64_t(data.LBA),
-		C.uint(data.BlockSize*data.Blocks), C.int(data.BlockSize),
-		0, 0, 0, 0, 0, syncCB, pdata,
-	) == nil {
-		return nil, errors.New("unable to start iscsi_read16_task")
+	task := start(syncCB, pdata)
+	if task == nil {
+		return nil, fmt.Errorf("unable to start %s: %s", name, C.GoString(C.iscsi_get_error(d.root().Context)))
 	}
-	if err := d.eventLoop(state); err != nil {
-		return nil, fmt.Errorf("error while waiting for task completion: %w", err)
+
+	if err := d.eventLoop(ctx, state); err != nil {
+		if ctx.Err() != nil {
+			d.abortTask(task)
+		} else {
+			err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+		}
+		// make sure libiscsi won't call back with private data that
+		// is about to be released
+		C.iscsi_scsi_cancel_task(d.root().Context, task)
+		C.scsi_free_scsi_task(task)
+		return nil, fmt.Errorf("error while waiting for %s completion: %w", name, err)
 	}
 
-	task := state.scsiTask
-	if task != nil {
-		defer C.scsi_free_scsi_task(task)
+	if state.status != C.SCSI_STATUS_GOOD {
+		var err error = newSCSIError(name, d.root().Context, state.status, task)
+		if state.status > 0xff && C.iscsi_is_logged_in(d.root().Context) == 0 {
+			err = fmt.Errorf("%w: %w", ErrConnectionLost, err)
+		}
+		C.scsi_free_scsi_task(task)
+		return nil, err
 	}
+	return task, nil
+}
+
+// how many times runIdempotentTask reissues a command whose connection
+// keeps getting lost before giving up on it
+const maxReissues = 5
 
-	if task == nil || task.status != C.SCSI_STATUS_GOOD {
-		return nil, fmt.Errorf("iscsi_read16_sync: %s", C.GoString(C.iscsi_get_error(d.Context)))
+// runIdempotentTask is runTask for commands that are safe to issue more
+// than once.  If the connection is lost while the command is outstanding
+// the session is recovered and the command reissued, up to maxReissues
+// times
+func (d *device) runIdempotentTask(ctx context.Context, name string, start func(C.iscsi_command_cb, unsafe.Pointer) *C.struct_scsi_task) (*C.struct_scsi_task, error) {
+	for reissues := 0; ; reissues++ {
+		task, err := d.runTask(ctx, name, start)
+		if err == nil || d.details.DisableRecovery || !errors.Is(err, ErrConnectionLost) {
+			return task, err
+		}
+		if recoverErr := d.recover(ctx, err); recoverErr != nil {
+			return nil, fmt.Errorf("%w (recovery failed: %w)", err, recoverErr)
+		}
+		if reissues == maxReissues {
+			return nil, fmt.Errorf("%w (gave up after %d reissues)", err, reissues)
+		}
+		logger().Info("reissuing command after recovery", slog.String("command", name))
 	}
-	logger().Debug("Read16 done", slog.Any("length", task.datain.size))
-	return C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size), nil
 }
 
-func (d *device) Read16Async(data Read16, tasks chan TaskResult) error {
-	cdata := callbackData{
-		tasks: tasks,
-		// add the read request so the callback can tell what lba the read
-		// started at.  i suspect this is probably also in the scsi_task
-		// but this is simple enough for now
-		context: data,
+// runTaskOnce is runTask for commands that must not be issued twice.  If
+// the connection is lost while the command is outstanding the session is
+// recovered, but the command isn't reissued since it may already have
+// taken effect, and ErrConnectionLost is returned
+func (d *device) runTaskOnce(ctx context.Context, name string, start func(C.iscsi_command_cb, unsafe.Pointer) *C.struct_scsi_task) (*C.struct_scsi_task, error) {
+	task, err := d.runTask(ctx, name, start)
+	if err == nil || d.details.DisableRecovery || !errors.Is(err, ErrConnectionLost) {
+		return task, err
 	}
-	pdata := gopointer.Save(cdata)
-	// can't call unref until the callback is done
-	task := C.iscsi_read16_task(d.Context, 0, C.uint64_t(data.LBA),
-		C.uint(data.BlockSize*data.Blocks), C.int(data.BlockSize), 0, 0, 0, 0, 0, channelCB, pdata)
-	if task == nil {
-		return errors.New("unable to start iscsi_read16_task")
+	if recoverErr := d.recover(ctx, err); recoverErr != nil {
+		return nil, fmt.Errorf("%w (recovery failed: %w)", err, recoverErr)
 	}
+	return nil, err
+}
 
+// runStatus starts a non-scsi command (login, logout, etc) and services
+// the connection until it completes or ctx is done
+func (d *device) runStatus(ctx context.Context, name string, start func(C.iscsi_command_cb, unsafe.Pointer) C.int) error {
+	root := d.root()
+	root.connMu.Lock()
+	defer root.connMu.Unlock()
+	state := &syncCallbackState{}
+	pdata := gopointer.Save(state)
+	defer gopointer.Unref(pdata)
+	if retval := start(statusCB, pdata); retval != 0 {
+		return fmt.Errorf("%s: (%d) %s", name, retval, C.GoString(C.iscsi_get_error(d.root().Context)))
+	}
+	if err := d.eventLoop(ctx, state); err != nil {
+		return fmt.Errorf("error while waiting for %s completion: %w", name, err)
+	}
+	if state.status != C.SCSI_STATUS_GOOD {
+		return fmt.Errorf("%s: (%d) %s", name, state.status, C.GoString(C.iscsi_get_error(d.root().Context)))
+	}
 	return nil
 }
 
-func (d *device) eventLoop(state *syncCallbackState) error {
-	// TODO: (willgorman) handle a timeout (from iscsi_set_timeout)
+// abortTask sends an ABORT TASK task management request for task and
+// waits a bounded amount of time for the target to respond.  The task
+// itself is left for the caller to cancel and free
+func (d *device) abortTask(task *C.struct_scsi_task) {
+	state := &syncCallbackState{}
+	pdata := gopointer.Save(state)
+	defer gopointer.Unref(pdata)
+	if C.iscsi_task_mgmt_abort_task_async(d.root().Context, task, statusCB, pdata) != 0 {
+		logger().Warn("unable to send abort task",
+			slog.String("error", C.GoString(C.iscsi_get_error(d.root().Context))))
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+	defer cancel()
+	if err := d.eventLoop(ctx, state); err != nil {
+		logger().Warn("abort task did not complete", slog.Any("error", err))
+	}
+}
+
+func (d *device) eventLoop(ctx context.Context, state *syncCallbackState) error {
 	// this gets set by iscsiSyncCB
-	for !state.finished {
+	return d.serviceUntil(ctx, func() bool { return state.finished })
+}
+
+// serviceUntil services the connection until done returns true
+func (d *device) serviceUntil(ctx context.Context, done func() bool) error {
+	for !done() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		timeout := 1000
+		if ctx.Done() != nil {
+			// wake up often enough to notice a cancelled context
+			timeout = 100
+		}
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = max(min(timeout, int(time.Until(deadline).Milliseconds())), 0)
+		}
 		events := d.WhichEvents()
 		fd := unix.PollFd{
 			Fd:      int32(d.GetFD()),
@@ -293,7 +726,7 @@ func (d *device) eventLoop(state *syncCallbackState) error {
 		}
 
 		fds := []unix.PollFd{fd}
-		_, err := unix.Poll(fds, 1000)
+		_, err := unix.Poll(fds, timeout)
 		// it's fine if the syscall got interrupted by a signal, we can just
 		// resume polling
 		if err != nil && err != syscall.EINTR {
@@ -301,14 +734,12 @@ func (d *device) eventLoop(state *syncCallbackState) error {
 		}
 		if d.HandleEvents(fds[0].Revents) < 0 {
 			return fmt.Errorf("failed to handle events: %s",
-				C.GoString(C.iscsi_get_error(d.Context)))
+				C.GoString(C.iscsi_get_error(d.root().Context)))
 		}
 	}
 	return nil
 }
 
-// TODO: Implement WriteSame
-
 // this is not safe to run in a goroutine other than the one
 // where all other operations on the iscsi connection are
 // being performed
@@ -320,28 +751,8 @@ func (d *device) ProcessAsync(ctx context.Context) error {
 		case <-ctx.Done():
 			return nil
 		default:
-			events := d.WhichEvents()
-			if events == 0 {
-				time.Sleep(10 * time.Millisecond)
-				continue
-			}
-			fd := unix.PollFd{
-				Fd:      int32(d.GetFD()),
-				Events:  int16(events),
-				Revents: 0,
-			}
-
-			fds := []unix.PollFd{fd}
-			_, err := unix.Poll(fds, 1000)
-			if err != nil {
-				if err.Error() != "interrupted system call" {
-					return fmt.Errorf("Poll error: %w", err)
-				}
-			}
-			// I think we have to call this with fds[0], not fd.
-			// fds[0] is what actually gets updated, fd is just a copy
-			if d.HandleEvents(fds[0].Revents) < 0 {
-				return errors.New("failed to handle events")
+			if err := d.processAsyncOnce(); err != nil {
+				return err
 			}
 		}
 	}
@@ -349,51 +760,64 @@ func (d *device) ProcessAsync(ctx context.Context) error {
 
 func (d *device) ProcessAsyncN(n int) error {
 	for i := 0; i < n; i++ {
-		events := d.WhichEvents()
-		if events == 0 {
-			time.Sleep(10 * time.Millisecond)
-			continue
-		}
-		fd := unix.PollFd{
-			Fd:      int32(d.GetFD()),
-			Events:  int16(events),
-			Revents: 0,
+		if err := d.processAsyncOnce(); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		fds := []unix.PollFd{fd}
-		_, err := unix.Poll(fds, 1000)
-		if err != nil {
-			if err.Error() != "interrupted system call" {
-				return fmt.Errorf("Poll error: %w", err)
-			}
-		}
-		// I think we have to call this with fds[0], not fd.
-		// fds[0] is what actually gets updated, fd is just a copy
-		if d.HandleEvents(fds[0].Revents) < 0 {
-			return errors.New("failed to handle events")
+func (d *device) processAsyncOnce() error {
+	if err := d.keepaliveErr(); err != nil {
+		return err
+	}
+	root := d.root()
+	root.connMu.Lock()
+	defer root.connMu.Unlock()
+	events := d.WhichEvents()
+	if events == 0 {
+		time.Sleep(10 * time.Millisecond)
+		return nil
+	}
+	fd := unix.PollFd{
+		Fd:      int32(d.GetFD()),
+		Events:  int16(events),
+		Revents: 0,
+	}
+
+	fds := []unix.PollFd{fd}
+	_, err := unix.Poll(fds, 1000)
+	if err != nil {
+		if err.Error() != "interrupted system call" {
+			return fmt.Errorf("Poll error: %w", err)
 		}
 	}
+	// I think we have to call this with fds[0], not fd.
+	// fds[0] is what actually gets updated, fd is just a copy
+	if d.HandleEvents(fds[0].Revents) < 0 {
+		return errors.New("failed to handle events")
+	}
 	return nil
 }
 
 func (d *device) GetFD() int {
-	return int(C.iscsi_get_fd(d.Context))
+	return int(C.iscsi_get_fd(d.root().Context))
 }
 
 func (d *device) WhichEvents() int {
-	return int(C.iscsi_which_events(d.Context))
+	return int(C.iscsi_which_events(d.root().Context))
 }
 
 func (d *device) HandleEvents(n int16) int {
-	return int(C.iscsi_service(d.Context, C.int(n)))
+	return int(C.iscsi_service(d.root().Context, C.int(n)))
 }
 
 func (d *device) GetQueueLength() int {
-	return int(C.iscsi_queue_length(d.Context))
+	return int(C.iscsi_queue_length(d.root().Context))
 }
 
 func (d *device) GetOutQueueLength() int {
-	return int(C.iscsi_out_queue_length(d.Context))
+	return int(C.iscsi_out_queue_length(d.root().Context))
 }
 
 func getReadCapacity10(task C.struct_scsi_task) (C.struct_scsi_readcapacity10, error) {
@@ -487,11 +911,24 @@ func (s scsiTask) getUint8(offset int) C.uint8_t {
 type Task struct {
 	Status int
 	DataIn []byte
+	// SenseKey, ASC and ASCQ are only set when Status
+	// is StatusCheckCondition
+	SenseKey SenseKey
+	ASC      uint8
+	ASCQ     uint8
 }
 
 type callbackData struct {
 	tasks   chan TaskResult
 	context any
+	// op is the libiscsi call that started the task
+	op string
+	// dev is the device that owns the connection, for keeping
+	// count of what's in flight
+	dev *device
+	// buf is a C copy of the data being written, if any
+	buf    unsafe.Pointer
+	handle *TaskHandle
 }
 
 type syncCallbackState struct {
@@ -500,54 +937,77 @@ type syncCallbackState struct {
 	scsiTask *C.struct_scsi_task
 }
 
+// TaskResult is delivered for every async command, whether it
+// succeeded or not.  Err is a *SCSIError when the command failed
 type TaskResult struct {
-	Task    Task
-	Err     error
+	Task Task
+	Err  error
+	// Context is the request that started the command, such
+	// as the Read16 passed to Read16Async
 	Context any
+	// Handle is what the async call that started the command
+	// returned
+	Handle *TaskHandle
 }
 
 //export iscsiChannelCB
 func iscsiChannelCB(iscsiCtx iscsiContext, status int, command_data, private_data unsafe.Pointer) {
 	defer gopointer.Unref(private_data)
 	data := gopointer.Restore(private_data).(callbackData)
+	data.dev.inFlight--
+	delete(data.dev.pending, data.handle)
+	data.handle.task = nil
+	C.free(data.buf)
 
-	if status != C.SCSI_STATUS_GOOD {
-		data.tasks <- TaskResult{
-			Err: errors.New(C.GoString(C.iscsi_get_error(iscsiCtx))),
-		}
-		return
-	}
-	// get command data onto the channel
+	// the task belongs to us now, and command_data is nil when
+	// libiscsi cancels a task
 	task := (*C.struct_scsi_task)(command_data)
-	defer C.free(command_data)
-
-	data.tasks <- TaskResult{
-		Task: Task{
-			Status: int(task.status),
-			DataIn: C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size),
-		},
+	if task != nil {
+		defer C.scsi_free_scsi_task(task)
+	}
+	result := TaskResult{
+		Task:    Task{Status: status},
 		Context: data.context,
+		Handle:  data.handle,
 	}
+	if status != C.SCSI_STATUS_GOOD {
+		err := newSCSIError(data.op, iscsiCtx, status, task)
+		result.Task.SenseKey = err.SenseKey
+		result.Task.ASC = err.ASC
+		result.Task.ASCQ = err.ASCQ
+		result.Err = err
+	} else if task.datain.size > 0 {
+		result.Task.DataIn = C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size)
+	}
+	data.tasks <- result
 }
 
 //export iscsiSyncCB
 func iscsiSyncCB(_ iscsiContext, status int, command_data, private_data unsafe.Pointer) {
+	state, ok := gopointer.Restore(private_data).(*syncCallbackState)
+	if !ok {
+		// the caller has already given up on this task
+		return
+	}
+	// command_data is nil when libiscsi cancels a task
 	task := (*C.struct_scsi_task)(command_data)
-	state := gopointer.Restore(private_data).(*syncCallbackState)
-	task.status = C.int(status)
+	if task != nil {
+		task.status = C.int(status)
+	}
 	state.status = status
 	state.finished = true
 	state.scsiTask = task
 }
 
-func printReadCapacity16(t *C.struct_scsi_readcapacity16) {
-	log.Printf("blocklength: %d\n", t.block_length)
-	log.Printf("lalba: %d\n", t.lalba)
-	log.Printf("lbpme: %d\n", t.lbpme)
-	log.Printf("lbppbe: %d\n", t.lbppbe)
-	log.Printf("lbprz: %d\n", t.lbprz)
-	log.Printf("piexp: %d\n", t.p_i_exp)
-	log.Printf("ptype: %d\n", t.p_type)
-	log.Printf("proten: %d\n", t.prot_en)
-	log.Printf("returnedlba: %d\n", t.returned_lba)
+// iscsiStatusCB is for commands where command_data isn't a scsi task
+// (logins, task management, etc) and only the status is of interest
+//
+//export iscsiStatusCB
+func iscsiStatusCB(_ iscsiContext, status int, command_data, private_data unsafe.Pointer) {
+	state, ok := gopointer.Restore(private_data).(*syncCallbackState)
+	if !ok {
+		return
+	}
+	state.status = status
+	state.finished = true
 }
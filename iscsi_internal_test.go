@@ -0,0 +1,106 @@
+package iscsi
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+	"gotest.tools/assert"
+)
+
+func TestAuthenticationFailure(t *testing.T) {
+	for _, msg := range []string{
+		"Failed to log in to target. Status: Authentication failure(513)",
+		"Failed to log in to target. Status: Authorization failure(514)",
+		"Failed to verify the target's CHAP response",
+	} {
+		err := authenticationFailure(msg)
+		assert.Assert(t, errors.Is(err, ErrAuthenticationFailed), msg)
+		assert.ErrorContains(t, err, msg)
+	}
+	for _, msg := range []string{
+		"",
+		"Failed to log in to target. Status: Target not found(515)",
+		"iscsi_service: socket error Connection refused(111)",
+	} {
+		assert.NilError(t, authenticationFailure(msg), msg)
+	}
+}
+
+func TestLoginErrorNotRetried(t *testing.T) {
+	loginErr := errors.New("login failed")
+	for _, tc := range []struct {
+		msg      string
+		attempts uint
+		authErr  bool
+	}{
+		{msg: "Failed to log in to target. Status: Authentication failure(513)", attempts: 1, authErr: true},
+		{msg: "Failed to log in to target. Status: Target not found(515)", attempts: 3},
+	} {
+		for _, retryable := range []func(error) bool{nil, func(error) bool { return true }} {
+			policy := RetryPolicy{
+				Attempts:  3,
+				Delay:     time.Millisecond,
+				MaxDelay:  time.Millisecond,
+				MaxJitter: time.Millisecond,
+				Retryable: retryable,
+			}
+			var attempts uint
+			err := retry.Do(func() error {
+				attempts++
+				return loginError(loginErr, authenticationFailure(tc.msg))
+			}, policy.options(context.Background())...)
+			assert.Equal(t, attempts, tc.attempts, tc.msg)
+			assert.Equal(t, errors.Is(err, ErrAuthenticationFailed), tc.authErr, err)
+		}
+	}
+}
+
+func TestReadChunkedShortTransfer(t *testing.T) {
+	const blockSize = 512
+	var calls [][2]int
+	data, err := readChunked(10, blockSize, 4, func(done, blocks int) ([]byte, error) {
+		calls = append(calls, [2]int{done, blocks})
+		chunk := bytes.Repeat([]byte{byte(done)}, blocks*blockSize)
+		if done == 4 {
+			// the second chunk only gets 3 of its 4 blocks
+			chunk = chunk[:3*blockSize]
+			return chunk, &ShortTransferError{Op: "iscsi_read16_task", Expected: blocks * blockSize, Transferred: len(chunk)}
+		}
+		return chunk, nil
+	})
+	assert.DeepEqual(t, calls, [][2]int{{0, 4}, {4, 4}})
+	var short *ShortTransferError
+	assert.Assert(t, errors.As(err, &short), err)
+	assert.Equal(t, short.Op, "iscsi_read16_task")
+	assert.Equal(t, short.Expected, 10*blockSize)
+	assert.Equal(t, short.Transferred, 7*blockSize)
+	assert.Assert(t, bytes.Equal(data, append(bytes.Repeat([]byte{0}, 4*blockSize), bytes.Repeat([]byte{4}, 3*blockSize)...)))
+
+	// anything else throws away what was read
+	data, err = readChunked(10, blockSize, 4, func(done, blocks int) ([]byte, error) {
+		if done == 4 {
+			return nil, ErrConnectionLost
+		}
+		return make([]byte, blocks*blockSize), nil
+	})
+	assert.Assert(t, errors.Is(err, ErrConnectionLost), err)
+	assert.Assert(t, data == nil)
+}
+
+func TestInvalidFieldInCDB(t *testing.T) {
+	invalidField := &SCSIError{Status: StatusCheckCondition, SenseKey: SenseKeyIllegalRequest, ASC: 0x24}
+	assert.Assert(t, invalidFieldInCDB(invalidField))
+	assert.Assert(t, invalidFieldInCDB(fmt.Errorf("wrapped: %w", invalidField)))
+	// WRITE SAME not supported at all, no point trying smaller
+	invalidOpcode := &SCSIError{Status: StatusCheckCondition, SenseKey: SenseKeyIllegalRequest, ASC: 0x20}
+	assert.Assert(t, !invalidFieldInCDB(invalidOpcode))
+	medium := &SCSIError{Status: StatusCheckCondition, SenseKey: SenseKeyMediumError, ASC: 0x24}
+	assert.Assert(t, !invalidFieldInCDB(medium))
+	assert.Assert(t, !invalidFieldInCDB(&SCSIError{Status: StatusReservationConflict}))
+	assert.Assert(t, !invalidFieldInCDB(nil))
+}
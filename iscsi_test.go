@@ -1,12 +1,16 @@
 package iscsi_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"math/rand"
+	"net/url"
 	"os"
 	"strings"
 	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/gostor/gotgt/pkg/config"
 	_ "github.com/gostor/gotgt/pkg/port/iscsit"
@@ -156,6 +160,74 @@ func TestWithGoTGT(t *testing.T) {
 	t.Log("data", string(data))
 }
 
+func TestContextDone(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 10*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = device.Read16Context(ctx, iscsi.Read16{LBA: 0, Blocks: 1, BlockSize: 512})
+	assert.Assert(t, errors.Is(err, context.Canceled), err)
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	err = device.Write16Context(ctx, iscsi.Write16{LBA: 0, Data: make([]byte, 512), BlockSize: 512})
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	// the device is still usable after the context errors
+	_, err = device.ReadCapacity16Context(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestContextDoneStalled(t *testing.T) {
+	targetURL := createAndRunTestTarget(t, 10*MiB)
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := runTCPProxy(t, u.Host)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    proxiedTargetURL(t, targetURL, proxy),
+	})
+	err = device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	// the read goes out but nothing ever comes back, so it has to be
+	// aborted and cancelled once the deadline passes
+	proxy.stalled.Store(true)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = device.Read16Context(ctx, iscsi.Read16{LBA: 0, Blocks: 8, BlockSize: 512})
+	assert.Assert(t, errors.Is(err, context.DeadlineExceeded), err)
+
+	// the stalled connection has lost data so it's no good any more,
+	// the device recovers onto a new one
+	proxy.stalled.Store(false)
+	proxy.drop()
+	ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	_, err = device.ReadCapacityContext(ctx)
+	assert.NilError(t, err)
+}
+
 func TestReadCapacity16(t *testing.T) {
 	testCases := []struct {
 		desc     string
@@ -166,16 +238,20 @@ func TestReadCapacity16(t *testing.T) {
 			desc: "1 MiB",
 			size: 1 * MiB,
 			expected: iscsi.Capacity{
-				MaxLBA:    (1 * MiB / 512) - 1,
-				BlockSize: 512,
+				MaxLBA:            (1 * MiB / 512) - 1,
+				BlockSize:         512,
+				PhysicalBlockSize: 512,
+				ThinProvisioned:   true,
 			},
 		},
 		{
 			desc: "3 TiB",
 			size: 3 * TiB,
 			expected: iscsi.Capacity{
-				MaxLBA:    (3 * TiB / 512) - 1,
-				BlockSize: 512,
+				MaxLBA:            (3 * TiB / 512) - 1,
+				BlockSize:         512,
+				PhysicalBlockSize: 512,
+				ThinProvisioned:   true,
 			},
 		},
 	}
@@ -247,3 +323,35 @@ func TestReadCapacity10(t *testing.T) {
 		})
 	}
 }
+
+func TestReadCapacity(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 3*TiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	cap, err := device.ReadCapacity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, cap.MaxLBA, (3*TiB/512)-1)
+	assert.Equal(t, cap.PhysicalBlockSize, 512)
+}
+
+func TestMutualCHAPRequiresInitiatorCredentials(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN:   "iqn.2024-10.libiscsi:go",
+		TargetURL:      createAndRunTestTarget(t, 1*MiB),
+		TargetUsername: "target",
+		TargetSecret:   "targetsecret",
+	})
+	err := device.Connect()
+	assert.ErrorContains(t, err, "mutual CHAP requires initiator credentials")
+}
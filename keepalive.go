@@ -0,0 +1,323 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+	"unsafe"
+
+	gopointer "github.com/mattn/go-pointer"
+	"golang.org/x/sys/unix"
+)
+
+// ErrKeepaliveTimeout is matched (along with ErrConnectionLost) by the
+// error a session fails with when the target stops answering keepalives
+var ErrKeepaliveTimeout = errors.New("no reply to iscsi keepalive")
+
+// the default for KeepaliveOptions.MaxMissed
+const defaultKeepaliveMaxMissed = 3
+
+// how often an idle connection is serviced so that NOP-Ins from the
+// target are answered promptly, regardless of the keepalive interval
+const keepaliveServiceInterval = time.Second
+
+type KeepaliveOptions struct {
+	// Interval is how often a NOP-Out is sent to the target.  Zero
+	// disables keepalives
+	Interval time.Duration
+	// MaxMissed is how many NOP-Outs may go unanswered before the
+	// session is considered dead.  Defaults to 3
+	MaxMissed int
+	// OnDead, if set, is called from the keepalive goroutine (or the
+	// Session's event loop) when the session is marked dead.  The
+	// next command fails with err, and unless recovery is disabled
+	// the session is then recovered.  OnDead must not call back
+	// into the device
+	OnDead func(err error)
+}
+
+// KeepaliveStats is a snapshot of the keepalive round trips on a session
+type KeepaliveStats struct {
+	Sent    uint64
+	Replies uint64
+	// Unanswered is how many NOP-Outs are currently waiting
+	// for a reply
+	Unanswered int
+	// LastRTT is the round trip time of the most recent reply and
+	// SmoothedRTT a moving average of them
+	LastRTT     time.Duration
+	SmoothedRTT time.Duration
+}
+
+type keepalive struct {
+	opts  KeepaliveOptions
+	pdata unsafe.Pointer
+	// stop and done are only set when the keepalive goroutine is
+	// running, Sessions send keepalives from their event loop instead
+	stop, done chan struct{}
+
+	mu sync.Mutex
+	// the unanswered NOP-Outs, oldest first
+	sent     []sentKeepalive
+	seq      uint64
+	lastSent time.Time
+	err      error
+	stats    KeepaliveStats
+}
+
+// each NOP-Out carries a sequence number which the target echoes back
+type sentKeepalive struct {
+	seq uint64
+	at  time.Time
+}
+
+func newKeepalive(opts KeepaliveOptions) *keepalive {
+	if opts.MaxMissed <= 0 {
+		opts.MaxMissed = defaultKeepaliveMaxMissed
+	}
+	k := &keepalive{opts: opts}
+	k.pdata = gopointer.Save(k)
+	return k
+}
+
+// startKeepalive sets up keepalives for a newly connected session and,
+// unless a Session's event loop is going to send them, starts the
+// goroutine that does
+func (d *device) startKeepalive() {
+	if d.details.Keepalive.Interval <= 0 {
+		return
+	}
+	k := newKeepalive(d.details.Keepalive)
+	d.keepalive = k
+	if d.loopOwned {
+		return
+	}
+	k.stop = make(chan struct{})
+	k.done = make(chan struct{})
+	go d.runKeepalive(k)
+}
+
+// stopKeepalive waits for the keepalive goroutine to exit.  It must be
+// called before the context is destroyed, and releaseKeepalive after
+func (d *device) stopKeepalive() {
+	if k := d.keepalive; k != nil && k.stop != nil {
+		close(k.stop)
+		<-k.done
+		k.stop = nil
+	}
+}
+
+func (d *device) releaseKeepalive() {
+	if k := d.keepalive; k != nil && k.pdata != nil {
+		gopointer.Unref(k.pdata)
+		k.pdata = nil
+	}
+}
+
+// runKeepalive services the connection whenever nothing else is using
+// it, which answers any NOP-Ins from the target, and sends a NOP-Out
+// every interval.  When the caller is busy with the connection it is
+// servicing it already, so the keepalive just waits its turn
+func (d *device) runKeepalive(k *keepalive) {
+	defer close(k.done)
+	ticker := time.NewTicker(min(k.opts.Interval, keepaliveServiceInterval))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.stop:
+			return
+		case <-ticker.C:
+		}
+		if !d.connMu.TryLock() {
+			continue
+		}
+		var err error
+		// async commands that nobody is servicing would have their
+		// completions delivered on this goroutine, so leave them be
+		if d.inFlight == 0 && k.failed() == nil {
+			err = d.keepaliveIdle(k)
+		}
+		d.connMu.Unlock()
+		if err != nil {
+			d.keepaliveDead(err)
+		}
+	}
+}
+
+// keepaliveIdle services an idle connection and sends a NOP-Out if
+// one is due.  connMu must be held
+func (d *device) keepaliveIdle(k *keepalive) error {
+	if err := d.servicePending(); err != nil {
+		return k.fail(fmt.Errorf("%w: %w", ErrConnectionLost, err))
+	}
+	if !k.due(time.Now()) {
+		return nil
+	}
+	if err := d.sendKeepalive(); err != nil {
+		return err
+	}
+	// get the NOP-Out on the wire
+	if err := d.servicePending(); err != nil {
+		return k.fail(fmt.Errorf("%w: %w", ErrConnectionLost, err))
+	}
+	return nil
+}
+
+// servicePending handles whatever the connection is ready
+// for without blocking
+func (d *device) servicePending() error {
+	fds := []unix.PollFd{{Fd: int32(d.GetFD()), Events: int16(d.WhichEvents())}}
+	if _, err := unix.Poll(fds, 0); err != nil && err != unix.EINTR {
+		return fmt.Errorf("poll failed: %w", err)
+	}
+	if d.HandleEvents(fds[0].Revents) < 0 {
+		return fmt.Errorf("failed to handle events: %s", C.GoString(C.iscsi_get_error(d.Context)))
+	}
+	return nil
+}
+
+// sendKeepalive sends a NOP-Out, first failing the session if too many
+// earlier ones have gone unanswered
+func (d *device) sendKeepalive() error {
+	k := d.keepalive
+	now := time.Now()
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if len(k.sent) >= k.opts.MaxMissed {
+		return k.failLocked(fmt.Errorf("%w: %w (%d unanswered)", ErrConnectionLost, ErrKeepaliveTimeout, len(k.sent)))
+	}
+	k.lastSent = now
+	k.seq++
+	var ping [8]byte
+	binary.BigEndian.PutUint64(ping[:], k.seq)
+	// libiscsi copies the ping data into the PDU
+	if C.iscsi_nop_out_async(d.Context, keepaliveCB, (*C.uchar)(unsafe.Pointer(&ping[0])), C.int(len(ping)), k.pdata) != 0 {
+		// try again next interval, if the connection really is gone
+		// the missed replies will catch it
+		logger().Warn("unable to send keepalive", slog.String("error", C.GoString(C.iscsi_get_error(d.Context))))
+		return nil
+	}
+	k.sent = append(k.sent, sentKeepalive{seq: k.seq, at: now})
+	k.stats.Sent++
+	return nil
+}
+
+// keepaliveDead reports a session the keepalive has given up on
+func (d *device) keepaliveDead(err error) {
+	logger().Error("iscsi session is dead", slog.Any("error", err))
+	if d.keepalive.opts.OnDead != nil {
+		d.keepalive.opts.OnDead(err)
+	}
+}
+
+// keepaliveErr returns the error the session failed with if the keepalive
+// has marked it dead
+func (d *device) keepaliveErr() error {
+	root := d.root()
+	if root.keepalive == nil {
+		return nil
+	}
+	return root.keepalive.failed()
+}
+
+// KeepaliveStats returns the keepalive round trips so far, or the zero
+// value if keepalives aren't enabled
+func (d *device) KeepaliveStats() KeepaliveStats {
+	root := d.root()
+	if root.keepalive == nil {
+		return KeepaliveStats{}
+	}
+	return root.keepalive.snapshot()
+}
+
+func (k *keepalive) due(now time.Time) bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err == nil && now.Sub(k.lastSent) >= k.opts.Interval
+}
+
+func (k *keepalive) failed() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.err
+}
+
+func (k *keepalive) fail(err error) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.failLocked(err)
+}
+
+func (k *keepalive) failLocked(err error) error {
+	k.err = err
+	k.sent = nil
+	return err
+}
+
+// reset clears out the state of the old connection once the
+// session has been reestablished
+func (k *keepalive) reset() {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.err = nil
+	k.sent = nil
+	k.lastSent = time.Now()
+}
+
+func (k *keepalive) snapshot() KeepaliveStats {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	stats := k.stats
+	stats.Unanswered = len(k.sent)
+	return stats
+}
+
+// replied records the reply to NOP-Out seq, or to the oldest outstanding
+// one if seq is 0
+func (k *keepalive) replied(seq uint64, now time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	// replies come back in order so anything sent before this one
+	// that's still waiting was lost, most likely along with a
+	// connection libiscsi has since replaced
+	i := 0
+	for seq != 0 && i < len(k.sent) && k.sent[i].seq < seq {
+		i++
+	}
+	if i == len(k.sent) || (seq != 0 && k.sent[i].seq != seq) {
+		return
+	}
+	rtt := now.Sub(k.sent[i].at)
+	k.sent = k.sent[i+1:]
+	k.stats.Replies++
+	k.stats.LastRTT = rtt
+	if k.stats.SmoothedRTT == 0 {
+		k.stats.SmoothedRTT = rtt
+	} else {
+		k.stats.SmoothedRTT += (rtt - k.stats.SmoothedRTT) / 8
+	}
+}
+
+//export iscsiKeepaliveCB
+func iscsiKeepaliveCB(_ iscsiContext, status int, command_data, private_data unsafe.Pointer) {
+	k, ok := gopointer.Restore(private_data).(*keepalive)
+	if !ok || status != C.SCSI_STATUS_GOOD {
+		return
+	}
+	// command_data is the data of the NOP-In, which should echo the
+	// ping but not every target bothers
+	var seq uint64
+	if data := (*C.struct_iscsi_data)(command_data); data != nil && data.size == 8 && data.data != nil {
+		seq = binary.BigEndian.Uint64(unsafe.Slice((*byte)(unsafe.Pointer(data.data)), 8))
+	}
+	k.replied(seq, time.Now())
+}
@@ -0,0 +1,106 @@
+package iscsi_test
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestKeepalive(t *testing.T) {
+	targetURL := createAndRunTestTarget(t, 1*MiB)
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := runTCPProxy(t, u.Host)
+
+	dead := make(chan error, 1)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    proxiedTargetURL(t, targetURL, proxy),
+		Keepalive: iscsi.KeepaliveOptions{
+			Interval:  50 * time.Millisecond,
+			MaxMissed: 2,
+			OnDead: func(err error) {
+				dead <- err
+			},
+		},
+	})
+	err = device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	// idle for a while, the keepalives should be answered
+	time.Sleep(500 * time.Millisecond)
+	stats := device.KeepaliveStats()
+	assert.Assert(t, stats.Replies > 0, "%+v", stats)
+	assert.Assert(t, stats.LastRTT > 0, "%+v", stats)
+	_, err = device.ReadCapacity()
+	assert.NilError(t, err)
+
+	// the connection stays up but nothing gets through
+	proxy.stalled.Store(true)
+	select {
+	case err = <-dead:
+		assert.Assert(t, errors.Is(err, iscsi.ErrKeepaliveTimeout), err)
+		assert.Assert(t, errors.Is(err, iscsi.ErrConnectionLost), err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalive didn't notice the stalled connection")
+	}
+
+	// the next command sees the session is dead and recovers it
+	// over a new connection
+	proxy.stalled.Store(false)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, err = device.ReadCapacityContext(ctx)
+	assert.NilError(t, err)
+}
+
+func TestSessionKeepalive(t *testing.T) {
+	targetURL := createAndRunTestTarget(t, 1*MiB)
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := runTCPProxy(t, u.Host)
+	dead := make(chan error, 1)
+	session, err := iscsi.NewSession(context.Background(), iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    proxiedTargetURL(t, targetURL, proxy),
+		Keepalive: iscsi.KeepaliveOptions{
+			Interval:  50 * time.Millisecond,
+			MaxMissed: 2,
+			OnDead: func(err error) {
+				dead <- err
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	proxy.stalled.Store(true)
+	select {
+	case <-dead:
+	case <-time.After(5 * time.Second):
+		t.Fatal("keepalive didn't notice the stalled connection")
+	}
+	// commands after the event loop has stopped get the reason it
+	// stopped rather than just being told the session is closed
+	_, err = session.ReadCapacity16(context.Background())
+	assert.Assert(t, errors.Is(err, iscsi.ErrKeepaliveTimeout), err)
+	assert.Assert(t, errors.Is(err, iscsi.ErrConnectionLost), err)
+}
@@ -0,0 +1,91 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+// rss returns the resident set size of the test process in bytes
+func rss(t *testing.T) int {
+	statm, err := os.ReadFile("/proc/self/statm")
+	if err != nil {
+		t.Skip("can't read RSS:", err)
+	}
+	fields := bytes.Fields(statm)
+	pages, err := strconv.Atoi(string(fields[1]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pages * os.Getpagesize()
+}
+
+// TestAsyncReadLeak checks that async results don't leak task memory.
+// It relies on cgocheck being enabled (GODEBUG=cgocheck=1, the default)
+// to also catch Go pointers escaping into libiscsi
+func TestAsyncReadLeak(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping leak test in short mode")
+	}
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 10*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	const blocks = 128
+	readAll := func(n int) {
+		results := make(chan iscsi.TaskResult, 64)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for r := range results {
+				// FailNow isn't allowed off the test goroutine
+				assert.Check(t, r.Err)
+				assert.Check(t, len(r.Task.DataIn) == blocks*512)
+			}
+		}()
+		for i := 0; i < n; i++ {
+			lba := (i * blocks) % (10 * MiB / 512)
+			_, err := device.Read16Async(iscsi.Read16{LBA: lba, Blocks: blocks, BlockSize: 512}, results)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for device.InFlight() > 0 {
+			if err := device.ProcessAsyncN(1); err != nil {
+				t.Fatal(err)
+			}
+		}
+		close(results)
+		<-done
+	}
+
+	// warm up so that the baseline includes buffers libiscsi and
+	// the target keep around
+	readAll(500)
+	runtime.GC()
+	debug.FreeOSMemory()
+	before := rss(t)
+
+	// 5000 reads of 64KiB would leak over 300MiB if the
+	// tasks' data-in buffers weren't released
+	readAll(5000)
+	runtime.GC()
+	debug.FreeOSMemory()
+	after := rss(t)
+	t.Logf("rss before %d after %d", before, after)
+	assert.Assert(t, after-before < 64*MiB, "rss grew by %d bytes", after-before)
+}
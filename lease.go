@@ -0,0 +1,175 @@
+package iscsi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// ErrLeaseHeld is returned from Acquire when another owner holds
+	// a lease that hasn't expired
+	ErrLeaseHeld = errors.New("lease is held by another owner")
+	// ErrLeaseLost is returned from Renew and Release when the lease
+	// block was changed by someone else since we last wrote it
+	ErrLeaseLost = errors.New("lease was lost")
+	// ErrLeaseNotHeld is returned from Renew and Release when
+	// the lease isn't held
+	ErrLeaseNotHeld = errors.New("lease is not held")
+)
+
+// identifies a block written by Lease
+var leaseMagic = []byte("ISCSILK1")
+
+// the magic, a timestamp and the length of the owner
+const leaseHeaderLen = 8 + 8 + 2
+
+// LeaseDevice is what a Lease needs from the LUN its block is on, which
+// the devices returned by New and LUN provide
+type LeaseDevice interface {
+	Read16Context(ctx context.Context, data Read16) ([]byte, error)
+	CompareAndWriteContext(ctx context.Context, data CompareAndWrite) error
+}
+
+// Lease is a simple lock between hosts sharing a LUN.  The owner and the
+// time it last renewed the lease are kept in a reserved block, which is
+// only ever changed with COMPARE AND WRITE so that two hosts can't both
+// take the lease.  A lease that hasn't been renewed within its TTL may
+// be taken by anyone, so hosts' clocks need to roughly agree
+type Lease struct {
+	dev       LeaseDevice
+	lba       int
+	blockSize int
+	owner     string
+	ttl       time.Duration
+	// held is the block as we last wrote it, nil if we
+	// don't hold the lease
+	held []byte
+}
+
+type LeaseHolder struct {
+	Owner string
+	// Timestamp is when the holder last acquired or renewed the lease
+	Timestamp time.Time
+}
+
+// NewLease returns a lease kept in the block at lba.  Nothing else
+// should use that block
+func NewLease(dev LeaseDevice, lba, blockSize int, owner string, ttl time.Duration) (*Lease, error) {
+	if blockSize <= leaseHeaderLen {
+		return nil, fmt.Errorf("lease block size must be more than %d bytes", leaseHeaderLen)
+	}
+	if ttl <= 0 {
+		return nil, errors.New("lease ttl must be positive")
+	}
+	if lba < 0 {
+		return nil, errors.New("lease lba must not be negative")
+	}
+	if len(owner) == 0 || len(owner) > blockSize-leaseHeaderLen {
+		return nil, fmt.Errorf("lease owner must be between 1 and %d bytes", blockSize-leaseHeaderLen)
+	}
+	return &Lease{
+		dev:       dev,
+		lba:       lba,
+		blockSize: blockSize,
+		owner:     owner,
+		ttl:       ttl,
+	}, nil
+}
+
+// Holder returns who holds the lease, if anyone.  An expired lease is
+// still reported, check the timestamp
+func (l *Lease) Holder(ctx context.Context) (LeaseHolder, bool, error) {
+	block, err := l.read(ctx)
+	if err != nil {
+		return LeaseHolder{}, false, err
+	}
+	holder, ok := decodeLease(block)
+	return holder, ok, nil
+}
+
+// Acquire takes the lease if it's free, expired or already ours
+func (l *Lease) Acquire(ctx context.Context) error {
+	current, err := l.read(ctx)
+	if err != nil {
+		return err
+	}
+	if holder, ok := decodeLease(current); ok && holder.Owner != l.owner && time.Since(holder.Timestamp) < l.ttl {
+		return fmt.Errorf("%w: %s since %s", ErrLeaseHeld, holder.Owner, holder.Timestamp.Format(time.RFC3339))
+	}
+	next := l.encode(time.Now())
+	err = l.dev.CompareAndWriteContext(ctx, CompareAndWrite{LBA: l.lba, Expected: current, Data: next, BlockSize: l.blockSize})
+	if errors.Is(err, ErrMiscompare) {
+		// someone else got there between our read and write
+		return fmt.Errorf("%w: %w", ErrLeaseHeld, err)
+	}
+	if err != nil {
+		return err
+	}
+	l.held = next
+	return nil
+}
+
+// Renew updates the lease's timestamp so that it doesn't expire
+func (l *Lease) Renew(ctx context.Context) error {
+	if l.held == nil {
+		return ErrLeaseNotHeld
+	}
+	next := l.encode(time.Now())
+	if err := l.swap(ctx, next); err != nil {
+		return err
+	}
+	l.held = next
+	return nil
+}
+
+// Release gives up the lease by clearing its block
+func (l *Lease) Release(ctx context.Context) error {
+	if l.held == nil {
+		return ErrLeaseNotHeld
+	}
+	if err := l.swap(ctx, make([]byte, l.blockSize)); err != nil {
+		return err
+	}
+	l.held = nil
+	return nil
+}
+
+func (l *Lease) swap(ctx context.Context, next []byte) error {
+	err := l.dev.CompareAndWriteContext(ctx, CompareAndWrite{LBA: l.lba, Expected: l.held, Data: next, BlockSize: l.blockSize})
+	if errors.Is(err, ErrMiscompare) {
+		l.held = nil
+		return fmt.Errorf("%w: %w", ErrLeaseLost, err)
+	}
+	return err
+}
+
+func (l *Lease) read(ctx context.Context) ([]byte, error) {
+	return l.dev.Read16Context(ctx, Read16{LBA: l.lba, Blocks: 1, BlockSize: l.blockSize})
+}
+
+func (l *Lease) encode(now time.Time) []byte {
+	block := make([]byte, l.blockSize)
+	copy(block, leaseMagic)
+	binary.BigEndian.PutUint64(block[8:16], uint64(now.UnixNano()))
+	binary.BigEndian.PutUint16(block[16:18], uint16(len(l.owner)))
+	copy(block[leaseHeaderLen:], l.owner)
+	return block
+}
+
+func decodeLease(block []byte) (LeaseHolder, bool) {
+	if len(block) < leaseHeaderLen || !bytes.Equal(block[:8], leaseMagic) {
+		return LeaseHolder{}, false
+	}
+	ownerLen := int(binary.BigEndian.Uint16(block[16:18]))
+	if leaseHeaderLen+ownerLen > len(block) {
+		return LeaseHolder{}, false
+	}
+	return LeaseHolder{
+		Owner:     string(block[leaseHeaderLen : leaseHeaderLen+ownerLen]),
+		Timestamp: time.Unix(0, int64(binary.BigEndian.Uint64(block[8:16]))),
+	}, true
+}
@@ -0,0 +1,124 @@
+package iscsi
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"gotest.tools/assert"
+)
+
+// fakeLeaseDevice keeps the lease block in memory and compares the
+// way a target would for COMPARE AND WRITE
+type fakeLeaseDevice struct {
+	block []byte
+}
+
+func (f *fakeLeaseDevice) Read16Context(_ context.Context, data Read16) ([]byte, error) {
+	return bytes.Clone(f.block), nil
+}
+
+func (f *fakeLeaseDevice) CompareAndWriteContext(_ context.Context, data CompareAndWrite) error {
+	for i := range data.Expected {
+		if data.Expected[i] != f.block[i] {
+			return &MiscompareError{Offset: i, Err: &SCSIError{
+				Op:       "iscsi_compareandwrite_task",
+				Status:   StatusCheckCondition,
+				SenseKey: SenseKeyMiscompare,
+			}}
+		}
+	}
+	f.block = bytes.Clone(data.Data)
+	return nil
+}
+
+func TestLeaseEncoding(t *testing.T) {
+	l, err := NewLease(&fakeLeaseDevice{}, 0, 512, "host-a", time.Minute)
+	assert.NilError(t, err)
+	now := time.Now()
+	block := l.encode(now)
+	assert.Equal(t, len(block), 512)
+	holder, ok := decodeLease(block)
+	assert.Assert(t, ok)
+	assert.Equal(t, holder.Owner, "host-a")
+	assert.Assert(t, holder.Timestamp.Equal(now), "%s != %s", holder.Timestamp, now)
+
+	// a released lease, or a block that was never a lease
+	_, ok = decodeLease(make([]byte, 512))
+	assert.Assert(t, !ok)
+
+	wrongMagic := bytes.Clone(block)
+	copy(wrongMagic, "ISCSILK2")
+	_, ok = decodeLease(wrongMagic)
+	assert.Assert(t, !ok)
+
+	tooLong := bytes.Clone(block)
+	binary.BigEndian.PutUint16(tooLong[16:18], 512-leaseHeaderLen+1)
+	_, ok = decodeLease(tooLong)
+	assert.Assert(t, !ok)
+
+	_, ok = decodeLease(block[:leaseHeaderLen-1])
+	assert.Assert(t, !ok)
+}
+
+func TestNewLeaseValidation(t *testing.T) {
+	dev := &fakeLeaseDevice{}
+	_, err := NewLease(dev, 0, 512, "host-a", 0)
+	assert.ErrorContains(t, err, "ttl")
+	_, err = NewLease(dev, 0, 0, "host-a", time.Minute)
+	assert.ErrorContains(t, err, "block size")
+	_, err = NewLease(dev, -1, 512, "host-a", time.Minute)
+	assert.ErrorContains(t, err, "lba")
+	_, err = NewLease(dev, 0, 512, "", time.Minute)
+	assert.ErrorContains(t, err, "owner")
+	_, err = NewLease(dev, 0, 512, string(make([]byte, 512-leaseHeaderLen+1)), time.Minute)
+	assert.ErrorContains(t, err, "owner")
+}
+
+func TestLease(t *testing.T) {
+	ctx := context.Background()
+	dev := &fakeLeaseDevice{block: make([]byte, 512)}
+	a, err := NewLease(dev, 0, 512, "host-a", time.Minute)
+	assert.NilError(t, err)
+	b, err := NewLease(dev, 0, 512, "host-b", time.Minute)
+	assert.NilError(t, err)
+
+	// neither can renew or release what they don't hold
+	assert.Assert(t, errors.Is(a.Renew(ctx), ErrLeaseNotHeld))
+	assert.Assert(t, errors.Is(b.Release(ctx), ErrLeaseNotHeld))
+
+	assert.NilError(t, a.Acquire(ctx))
+	holder, ok, err := b.Holder(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, ok)
+	assert.Equal(t, holder.Owner, "host-a")
+	err = b.Acquire(ctx)
+	assert.Assert(t, errors.Is(err, ErrLeaseHeld), err)
+	assert.Assert(t, errors.Is(b.Renew(ctx), ErrLeaseNotHeld))
+	assert.NilError(t, a.Renew(ctx))
+
+	// a hasn't renewed within the ttl so b can take over
+	dev.block = a.encode(time.Now().Add(-2 * time.Minute))
+	a.held = bytes.Clone(dev.block)
+	assert.NilError(t, b.Acquire(ctx))
+
+	// a finds out when it next writes the block
+	err = a.Renew(ctx)
+	assert.Assert(t, errors.Is(err, ErrLeaseLost), err)
+	assert.Assert(t, errors.Is(err, ErrMiscompare), err)
+	assert.Assert(t, a.held == nil)
+	assert.Assert(t, errors.Is(a.Release(ctx), ErrLeaseNotHeld))
+	holder, _, err = a.Holder(ctx)
+	assert.NilError(t, err)
+	assert.Equal(t, holder.Owner, "host-b")
+
+	assert.NilError(t, b.Release(ctx))
+	assert.Assert(t, bytes.Equal(dev.block, make([]byte, 512)))
+	_, ok, err = a.Holder(ctx)
+	assert.NilError(t, err)
+	assert.Assert(t, !ok)
+	assert.NilError(t, a.Acquire(ctx))
+}
@@ -0,0 +1,156 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Digest is which digests the initiator offers at login, in order of
+// preference.  The target picks the first one it also supports
+type Digest int
+
+const (
+	// DigestDefault keeps libiscsi's behaviour, which for header
+	// digests is DigestNoneOrCRC32C and for data digests DigestNone
+	DigestDefault Digest = iota
+	DigestNone
+	DigestCRC32C
+	DigestNoneOrCRC32C
+	DigestCRC32COrNone
+)
+
+// LoginOption is a yes/no login key that can be left at
+// libiscsi's default
+type LoginOption int
+
+const (
+	LoginOptionDefault LoginOption = iota
+	LoginOptionYes
+	LoginOptionNo
+)
+
+// the MaxRecvDataSegmentLength and FirstBurstLength libiscsi offers at
+// login, it has no way to change them.  See libiscsiMaxBurstLength
+const (
+	libiscsiMaxRecvDataSegmentLength = 262144
+	libiscsiFirstBurstLength         = 262144
+)
+
+// LoginParams are the login keys of a session.  libiscsi doesn't expose
+// the target's answers so these are what the initiator offered.  The
+// target picks one of an either/or digest, can refuse ImmediateData or
+// insist on InitialR2T, and can negotiate the lengths down
+type LoginParams struct {
+	HeaderDigest  Digest
+	DataDigest    Digest
+	ImmediateData bool
+	InitialR2T    bool
+	// the lengths are fixed by libiscsi
+	MaxRecvDataSegmentLength int
+	FirstBurstLength         int
+	MaxBurstLength           int
+}
+
+// NegotiatedParams returns the login keys offered when the session
+// logged in, see LoginParams for what the target may have changed
+func (d *device) NegotiatedParams() (LoginParams, error) {
+	root := d.root()
+	if root.Context == nil || C.iscsi_is_logged_in(root.Context) == 0 {
+		return LoginParams{}, errors.New("NegotiatedParams: not logged in")
+	}
+	return offeredLoginParams(root.details), nil
+}
+
+// offeredLoginParams works out what setLoginOptions has libiscsi offer
+func offeredLoginParams(details ConnectionDetails) LoginParams {
+	params := LoginParams{
+		HeaderDigest:             details.HeaderDigest,
+		DataDigest:               details.DataDigest,
+		ImmediateData:            details.ImmediateData != LoginOptionNo,
+		InitialR2T:               details.InitialR2T == LoginOptionYes,
+		MaxRecvDataSegmentLength: libiscsiMaxRecvDataSegmentLength,
+		FirstBurstLength:         libiscsiFirstBurstLength,
+		MaxBurstLength:           libiscsiMaxBurstLength,
+	}
+	if params.HeaderDigest == DigestDefault {
+		params.HeaderDigest = DigestNoneOrCRC32C
+	}
+	if params.DataDigest == DigestDefault {
+		params.DataDigest = DigestNone
+	}
+	return params
+}
+
+// setLoginOptions applies the login keys from the connection details
+// that differ from libiscsi's defaults
+func (d *device) setLoginOptions() error {
+	header := C.ISCSI_HEADER_DIGEST_NONE_CRC32C
+	switch d.details.HeaderDigest {
+	case DigestDefault, DigestNoneOrCRC32C:
+	case DigestNone:
+		header = C.ISCSI_HEADER_DIGEST_NONE
+	case DigestCRC32C:
+		header = C.ISCSI_HEADER_DIGEST_CRC32C
+	case DigestCRC32COrNone:
+		header = C.ISCSI_HEADER_DIGEST_CRC32C_NONE
+	default:
+		return fmt.Errorf("invalid header digest %d", d.details.HeaderDigest)
+	}
+	if C.iscsi_set_header_digest(d.Context, uint32(header)) != 0 {
+		return fmt.Errorf("error setting header digest: %s", C.GoString(C.iscsi_get_error(d.Context)))
+	}
+
+	if d.details.DataDigest != DigestDefault {
+		var data uint32
+		switch d.details.DataDigest {
+		case DigestNone:
+			data = C.ISCSI_DATA_DIGEST_NONE
+		case DigestCRC32C:
+			data = C.ISCSI_DATA_DIGEST_CRC32C
+		case DigestNoneOrCRC32C:
+			data = C.ISCSI_DATA_DIGEST_NONE_CRC32C
+		case DigestCRC32COrNone:
+			data = C.ISCSI_DATA_DIGEST_CRC32C_NONE
+		default:
+			return fmt.Errorf("invalid data digest %d", d.details.DataDigest)
+		}
+		if C.iscsi_set_data_digest(d.Context, data) != 0 {
+			return fmt.Errorf("error setting data digest: %s", C.GoString(C.iscsi_get_error(d.Context)))
+		}
+	}
+
+	switch d.details.ImmediateData {
+	case LoginOptionDefault:
+	case LoginOptionYes, LoginOptionNo:
+		value := uint32(C.ISCSI_IMMEDIATE_DATA_YES)
+		if d.details.ImmediateData == LoginOptionNo {
+			value = C.ISCSI_IMMEDIATE_DATA_NO
+		}
+		if C.iscsi_set_immediate_data(d.Context, value) != 0 {
+			return fmt.Errorf("error setting ImmediateData: %s", C.GoString(C.iscsi_get_error(d.Context)))
+		}
+	default:
+		return fmt.Errorf("invalid ImmediateData option %d", d.details.ImmediateData)
+	}
+
+	switch d.details.InitialR2T {
+	case LoginOptionDefault:
+	case LoginOptionYes, LoginOptionNo:
+		value := uint32(C.ISCSI_INITIAL_R2T_YES)
+		if d.details.InitialR2T == LoginOptionNo {
+			value = C.ISCSI_INITIAL_R2T_NO
+		}
+		if C.iscsi_set_initial_r2t(d.Context, value) != 0 {
+			return fmt.Errorf("error setting InitialR2T: %s", C.GoString(C.iscsi_get_error(d.Context)))
+		}
+	default:
+		return fmt.Errorf("invalid InitialR2T option %d", d.details.InitialR2T)
+	}
+	return nil
+}
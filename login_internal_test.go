@@ -0,0 +1,30 @@
+package iscsi
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestOfferedLoginParams(t *testing.T) {
+	// libiscsi's own defaults
+	assert.DeepEqual(t, offeredLoginParams(ConnectionDetails{}), LoginParams{
+		HeaderDigest:             DigestNoneOrCRC32C,
+		DataDigest:               DigestNone,
+		ImmediateData:            true,
+		InitialR2T:               false,
+		MaxRecvDataSegmentLength: 262144,
+		FirstBurstLength:         262144,
+		MaxBurstLength:           262144,
+	})
+	params := offeredLoginParams(ConnectionDetails{
+		HeaderDigest:  DigestCRC32C,
+		DataDigest:    DigestCRC32COrNone,
+		ImmediateData: LoginOptionNo,
+		InitialR2T:    LoginOptionYes,
+	})
+	assert.Equal(t, params.HeaderDigest, DigestCRC32C)
+	assert.Equal(t, params.DataDigest, DigestCRC32COrNone)
+	assert.Equal(t, params.ImmediateData, false)
+	assert.Equal(t, params.InitialR2T, true)
+}
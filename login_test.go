@@ -0,0 +1,61 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestLoginOptions(t *testing.T) {
+	url := createAndRunTestTarget(t, 1*MiB)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN:  "iqn.2024-10.libiscsi:go",
+		TargetURL:     url,
+		HeaderDigest:  iscsi.DigestNone,
+		DataDigest:    iscsi.DigestNone,
+		ImmediateData: iscsi.LoginOptionNo,
+		InitialR2T:    iscsi.LoginOptionYes,
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	params, err := device.NegotiatedParams()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, params, iscsi.LoginParams{
+		HeaderDigest:             iscsi.DigestNone,
+		DataDigest:               iscsi.DigestNone,
+		ImmediateData:            false,
+		InitialR2T:               true,
+		MaxRecvDataSegmentLength: 262144,
+		FirstBurstLength:         262144,
+		MaxBurstLength:           262144,
+	})
+	// LUN handles share the session's parameters
+	lunParams, err := device.LUN(0).NegotiatedParams()
+	assert.NilError(t, err)
+	assert.DeepEqual(t, lunParams, params)
+
+	// with no immediate or unsolicited data every write waits for an R2T
+	data := bytes.Repeat([]byte("r2t only"), 512/8*16)
+	err = device.Write16(iscsi.Write16{LBA: 0, Data: data, BlockSize: 512})
+	assert.NilError(t, err)
+	read, err := device.Read16(iscsi.Read16{LBA: 0, Blocks: 16, BlockSize: 512})
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(read, data))
+
+	device = iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    url,
+		HeaderDigest: iscsi.Digest(42),
+	})
+	assert.ErrorContains(t, device.Connect(), "invalid header digest")
+	_, err = device.NegotiatedParams()
+	assert.ErrorContains(t, err, "not logged in")
+}
@@ -0,0 +1,96 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"unsafe"
+)
+
+var errLUNHandle = errors.New("LUN handles share the session of the device they were opened from")
+
+// LUN returns a handle to another logical unit of the same target that
+// issues its commands over d's logged in session instead of logging in
+// again.  The handle is only usable while d stays connected, and like d
+// itself it is not safe to use concurrently with d or other handles
+func (d *device) LUN(lun int) *device {
+	parent := d
+	if d.parent != nil {
+		parent = d.parent
+	}
+	// the handle has no Context of its own, commands look up the
+	// parent's when they run since it's replaced on every Connect
+	return &device{
+		targetName:   parent.targetName,
+		targetPortal: parent.targetPortal,
+		targetLun:    lun,
+		details:      parent.details,
+		parent:       parent,
+	}
+}
+
+// ReportLUNs returns the logical units that the target exposes
+// to this initiator
+func (d *device) ReportLUNs() ([]int, error) {
+	return d.ReportLUNsContext(context.Background())
+}
+
+func (d *device) ReportLUNsContext(ctx context.Context) ([]int, error) {
+	// enough for 511 luns in the first attempt, if the target has more
+	// than that we'll ask again with the size it says it needs
+	allocLen := 4096
+	for {
+		task, err := d.runIdempotentTask(ctx, "iscsi_reportluns_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+			return C.iscsi_reportluns_task(d.root().Context, 0, C.int(allocLen), cb, pdata)
+		})
+		if err != nil {
+			return nil, err
+		}
+		dataIn := C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size)
+		C.scsi_free_scsi_task(task)
+		if len(dataIn) < 8 {
+			return nil, errors.New("unexpected size")
+		}
+		listLen := int(binary.BigEndian.Uint32(dataIn[:4]))
+		if listLen+8 > allocLen {
+			allocLen = listLen + 8
+			continue
+		}
+		luns, err := parseReportLUNs(dataIn)
+		if err != nil {
+			return nil, err
+		}
+		logger().Debug("ReportLUNs", slog.Any("luns", luns))
+		return luns, nil
+	}
+}
+
+// parseReportLUNs decodes the lun list returned by REPORT LUNS,
+// supporting the peripheral and flat single level addressing
+// methods that iscsi targets use in practice
+func parseReportLUNs(dataIn []byte) ([]int, error) {
+	listLen := int(binary.BigEndian.Uint32(dataIn[:4]))
+	entries := dataIn[8:min(8+listLen, len(dataIn))]
+	luns := make([]int, 0, len(entries)/8)
+	for i := 0; i+8 <= len(entries); i += 8 {
+		entry := entries[i : i+8]
+		switch entry[0] >> 6 {
+		case 0: // peripheral device addressing
+			luns = append(luns, int(entry[1]))
+		case 1: // flat space addressing
+			luns = append(luns, int(entry[0]&0x3f)<<8|int(entry[1]))
+		default:
+			return nil, fmt.Errorf("unsupported lun address method in % x", entry)
+		}
+	}
+	return luns, nil
+}
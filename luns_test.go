@@ -0,0 +1,140 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/gostor/gotgt/pkg/config"
+	"github.com/gostor/gotgt/pkg/scsi"
+	"github.com/hashicorp/consul/sdk/freeport"
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+// runMultiLUNTestTarget is like runTestTarget but exposes each of the
+// target files as its own LUN, numbered from 0
+func runMultiLUNTestTarget(t testing.TB, targetFiles ...string) (url string) {
+	port := freeport.GetOne(t)
+	targetIQN := "iqn.2024-10.com.example:0:multi"
+	c := &config.Config{
+		ISCSIPortals: []config.ISCSIPortalInfo{
+			{ID: 0, Portal: fmt.Sprintf("127.0.0.1:%d", port)},
+		},
+		ISCSITargets: map[string]config.ISCSITarget{
+			targetIQN: {
+				TPGTs: map[string][]uint64{
+					"1": {0},
+				},
+				LUNs: map[string]uint64{},
+			},
+		},
+	}
+	for i, targetFile := range targetFiles {
+		id := uint64(deviceID.Add(1))
+		c.Storages = append(c.Storages, config.BackendStorage{
+			DeviceID:         id,
+			Path:             fmt.Sprintf("file:%s", targetFile),
+			Online:           true,
+			ThinProvisioning: true,
+		})
+		c.ISCSITargets[targetIQN].LUNs[fmt.Sprint(i)] = id
+	}
+	err := scsi.InitSCSILUMap(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgtsvc := scsi.NewSCSITargetService()
+	targetDriver, err := scsi.NewTargetDriver("iscsi", tgtsvc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tgtname := range c.ISCSITargets {
+		err = targetDriver.NewTarget(tgtname, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	go targetDriver.Run(port)
+	t.Cleanup(func() { _ = targetDriver.Close() })
+	return fmt.Sprintf("iscsi://127.0.0.1:%d/%s/0", port, targetIQN)
+}
+
+func TestReportLUNs(t *testing.T) {
+	nluns := 4
+	var files []string
+	for i := 0; i < nluns; i++ {
+		files = append(files, createTargetTempfile(t, int64(i+1)*MiB))
+	}
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runMultiLUNTestTarget(t, files...),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	luns, err := device.ReportLUNs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, luns, []int{0, 1, 2, 3})
+
+	for _, lun := range luns {
+		handle := device.LUN(lun)
+		cap, err := handle.ReadCapacity16()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// each lun was sized differently so this proves the
+		// commands went to the right one
+		assert.Equal(t, (cap.MaxLBA+1)*cap.BlockSize, (lun+1)*MiB)
+
+		write := bytes.Repeat([]byte{byte(lun)}, cap.BlockSize)
+		err = handle.Write16(iscsi.Write16{LBA: 0, Data: write, BlockSize: cap.BlockSize})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.NilError(t, handle.Disconnect())
+	}
+
+	// the handles didn't log out the shared session
+	for _, lun := range luns {
+		data, err := device.LUN(lun).Read16(iscsi.Read16{LBA: 0, Blocks: 1, BlockSize: 512})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Assert(t, bytes.Equal(data, bytes.Repeat([]byte{byte(lun)}, 512)))
+	}
+}
+
+func TestLUNHandleAfterConnect(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runMultiLUNTestTarget(t, createTargetTempfile(t, 1*MiB), createTargetTempfile(t, 2*MiB)),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+	handle := device.LUN(1)
+	_, err = handle.ReadCapacity16()
+	assert.NilError(t, err)
+
+	// logging in again replaces the parent's libiscsi context,
+	// the handle has to follow it to the new one
+	err = device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cap, err := handle.ReadCapacity16()
+	assert.NilError(t, err)
+	assert.Equal(t, (cap.MaxLBA+1)*cap.BlockSize, 2*MiB)
+}
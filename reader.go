@@ -12,10 +12,12 @@ type reader struct {
 	lba       int64
 	offset    int64
 	blocksize int64
+	// cache is only set by CachedReader
+	cache *blockCache
 }
 
 func Reader(dev *device) (*reader, error) {
-	c, err := dev.ReadCapacity16()
+	c, err := dev.ReadCapacity()
 	if err != nil {
 		return nil, fmt.Errorf("failed to get capacity of device: %w", err)
 	}
@@ -39,6 +41,9 @@ func (r *reader) Read(p []byte) (n int, err error) {
 }
 
 func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
+	if r.cache != nil {
+		return r.cachedReadAt(p, off)
+	}
 	if off >= r.blocksize*r.lba {
 		logger().Debug("offset past at EOF", slog.Int("offset", int(off)))
 		return 0, io.EOF
@@ -78,10 +83,8 @@ func (r *reader) ReadAt(p []byte, off int64) (n int, err error) {
 	if err == io.EOF {
 		result = readBytes[blockOffset:]
 	} else if blockOffset > 0 {
-		// sometimes we get fewer than the number of requested blocks
-		// even when not near the max lba? (at least when testing with gotgt)
-		// unclear yet if this is acceptable for iscsi or a flaw in gotgt
-		// make sure not to overshoot length of readBytes in that case
+		// Read16 fetches any blocks the target leaves out, but the
+		// last block may only be partly wanted so don't overshoot
 		result = readBytes[blockOffset:min(l+int(blockOffset), len(readBytes))]
 	} else {
 		result = readBytes[:l]
@@ -0,0 +1,123 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+	"unsafe"
+)
+
+// PowerCondition is the POWER CONDITION field of START STOP UNIT
+type PowerCondition int
+
+const (
+	// PowerConditionStartValid means the START and LOEJ bits
+	// are to be acted on rather than a power condition
+	PowerConditionStartValid PowerCondition = 0x0
+	PowerConditionActive     PowerCondition = 0x1
+	PowerConditionIdle       PowerCondition = 0x2
+	PowerConditionStandby    PowerCondition = 0x3
+	// PowerConditionLUControl hands control of the power condition
+	// back to the logical unit
+	PowerConditionLUControl    PowerCondition = 0x7
+	PowerConditionForceIdle    PowerCondition = 0xa
+	PowerConditionForceStandby PowerCondition = 0xb
+)
+
+type StartStopUnit struct {
+	// Start spins the unit up, or down if false.  Along with
+	// LoadEject it's only acted on when PowerCondition is
+	// PowerConditionStartValid
+	Start bool
+	// LoadEject loads the medium if Start is set, otherwise ejects it
+	LoadEject bool
+	// Immediate has the target return as soon as the CDB has been
+	// validated instead of when the operation completes
+	Immediate bool
+	// NoFlush skips writing the cache to the medium before stopping
+	NoFlush                bool
+	PowerCondition         PowerCondition
+	PowerConditionModifier int
+}
+
+// how often WaitReady polls a unit that is becoming ready
+const waitReadyInterval = 250 * time.Millisecond
+
+// TestUnitReady returns nil if the LUN is ready to accept commands.
+// Otherwise it returns a *SCSIError which typically matches ErrNotReady or
+// ErrUnitAttention.  Reporting a unit attention clears it on the target
+func (d *device) TestUnitReady() error {
+	return d.TestUnitReadyContext(context.Background())
+}
+
+func (d *device) TestUnitReadyContext(ctx context.Context) error {
+	logger().Debug("TestUnitReady")
+	task, err := d.runIdempotentTask(ctx, "iscsi_testunitready_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_testunitready_task(d.root().Context, C.int(d.targetLun), cb, pdata)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
+// StartStopUnit changes the power condition of the LUN, or starts,
+// stops, loads or ejects it
+func (d *device) StartStopUnit(s StartStopUnit) error {
+	return d.StartStopUnitContext(context.Background(), s)
+}
+
+func (d *device) StartStopUnitContext(ctx context.Context, s StartStopUnit) error {
+	logger().Debug("StartStopUnit", slog.Bool("start", s.Start), slog.Bool("loej", s.LoadEject),
+		slog.Int("pc", int(s.PowerCondition)))
+	if s.PowerCondition < 0 || s.PowerCondition > 0xf || s.PowerConditionModifier < 0 || s.PowerConditionModifier > 0xf {
+		return errors.New("StartStopUnit: power condition and modifier must fit in 4 bits")
+	}
+	task, err := d.runIdempotentTask(ctx, "iscsi_startstopunit_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_startstopunit_task(d.root().Context, C.int(d.targetLun), cBool(s.Immediate),
+			C.int(s.PowerConditionModifier), C.int(s.PowerCondition), cBool(s.NoFlush),
+			cBool(s.LoadEject), cBool(s.Start), cb, pdata)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
+// WaitReady polls TEST UNIT READY until the LUN is ready or ctx is done.
+// Pending unit attentions, such as those reported after login or when
+// the LUN is resized, are cleared along the way.  Errors other than
+// not ready or unit attention are returned immediately
+func (d *device) WaitReady(ctx context.Context) error {
+	for {
+		err := d.TestUnitReadyContext(ctx)
+		switch {
+		case err == nil:
+			return nil
+		case errors.Is(err, ErrUnitAttention):
+			// reporting it cleared it, there may be more queued
+			// up behind it so go straight round again
+			logger().Info("cleared unit attention", slog.Any("error", err))
+			continue
+		case !errors.Is(err, ErrNotReady):
+			return err
+		}
+		logger().Debug("waiting for unit to become ready", slog.Any("error", err))
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("WaitReady: %w (last error: %w)", ctx.Err(), err)
+		case <-time.After(waitReadyInterval):
+		}
+	}
+}
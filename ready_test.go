@@ -0,0 +1,32 @@
+package iscsi_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestUnitReady(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 1*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NilError(t, device.WaitReady(ctx))
+	assert.NilError(t, device.TestUnitReady())
+	assert.NilError(t, device.StartStopUnit(iscsi.StartStopUnit{Start: true}))
+	assert.NilError(t, device.StartStopUnit(iscsi.StartStopUnit{PowerCondition: iscsi.PowerConditionIdle}))
+	assert.NilError(t, device.TestUnitReady())
+}
@@ -0,0 +1,132 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/avast/retry-go/v4"
+)
+
+// ErrConnectionLost is returned (wrapped) when a command fails because
+// the connection to the target dropped rather than because the target
+// rejected it
+var ErrConnectionLost = errors.New("iscsi connection lost")
+
+// RetryPolicy controls how failed logins are retried.  The zero value
+// retries up to 20 times with an exponential backoff starting at 100ms
+// and capped at 500ms, plus up to 100ms of random jitter
+type RetryPolicy struct {
+	// Attempts is the maximum number of login attempts, including the
+	// first one
+	Attempts uint
+	// Delay is the backoff before the first retry, doubling after each
+	// attempt up to MaxDelay
+	Delay    time.Duration
+	MaxDelay time.Duration
+	// MaxJitter is the most random delay added to each backoff
+	MaxJitter time.Duration
+	// Retryable decides whether a failed attempt should be retried.  By
+	// default everything is retried except authentication failures.
+	// Retryable is never consulted for those
+	Retryable func(error) bool
+	// OnRetry, if set, is called after each failed attempt that is going
+	// to be retried
+	OnRetry func(attempt uint, err error)
+}
+
+func (p RetryPolicy) options(ctx context.Context) []retry.Option {
+	attempts := p.Attempts
+	if attempts == 0 {
+		attempts = 20
+	}
+	delay := p.Delay
+	if delay == 0 {
+		delay = 100 * time.Millisecond
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = 500 * time.Millisecond
+	}
+	maxJitter := p.MaxJitter
+	if maxJitter == 0 {
+		maxJitter = 100 * time.Millisecond
+	}
+	opts := []retry.Option{
+		retry.Context(ctx),
+		retry.Attempts(attempts),
+		retry.Delay(delay),
+		retry.MaxDelay(maxDelay),
+		retry.MaxJitter(maxJitter),
+		retry.DelayType(retry.CombineDelay(retry.BackOffDelay, retry.RandomDelay)),
+		retry.OnRetry(func(n uint, err error) {
+			// retry-go also calls this after the final attempt
+			if n+1 >= attempts {
+				return
+			}
+			logger().Debug("retrying login", slog.Uint64("attempt", uint64(n+1)), slog.Any("error", err))
+			if p.OnRetry != nil {
+				p.OnRetry(n+1, err)
+			}
+		}),
+	}
+	if p.Retryable != nil {
+		opts = append(opts, retry.RetryIf(func(err error) bool {
+			return retry.IsRecoverable(err) && p.Retryable(err)
+		}))
+	}
+	return opts
+}
+
+// how long a single reconnect attempt may take before it counts
+// as failed and the RetryPolicy decides what happens next
+const reconnectTimeout = 30 * time.Second
+
+// reconnect starts libiscsi's reconnect, which logs in over a new
+// connection and requeues any outstanding tasks, and services the
+// connection until the login completes
+func (d *device) reconnect(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, reconnectTimeout)
+	defer cancel()
+	d.connMu.Lock()
+	defer d.connMu.Unlock()
+	if retval := C.iscsi_reconnect(d.Context); retval != 0 {
+		return fmt.Errorf("iscsi_reconnect: (%d) %s", retval, C.GoString(C.iscsi_get_error(d.Context)))
+	}
+	if d.keepalive != nil {
+		// the old connection and anything the keepalive was
+		// waiting on are gone
+		d.keepalive.reset()
+	}
+	if err := d.serviceUntil(ctx, func() bool { return C.iscsi_is_logged_in(d.Context) != 0 }); err != nil {
+		return fmt.Errorf("iscsi_reconnect: %w", err)
+	}
+	return nil
+}
+
+// recover reestablishes a session that failed with cause.  LUN handles
+// recover the session they share with their parent
+func (d *device) recover(ctx context.Context, cause error) error {
+	if d.parent != nil {
+		return d.parent.recover(ctx, cause)
+	}
+	logger().Warn("iscsi session lost, recovering", slog.Any("cause", cause))
+	err := d.ReconnectContext(ctx)
+	if err != nil {
+		logger().Error("iscsi session recovery failed", slog.Any("error", err))
+	} else {
+		logger().Info("iscsi session recovered")
+	}
+	if d.details.OnRecovery != nil {
+		d.details.OnRecovery(cause, err)
+	}
+	return err
+}
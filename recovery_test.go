@@ -0,0 +1,227 @@
+package iscsi_test
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/consul/sdk/freeport"
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+// tcpProxy forwards connections to a target and can sever all of
+// them at once to simulate a network failure or controller failover,
+// or silently discard traffic like a firewall that dropped the flow
+type tcpProxy struct {
+	l       net.Listener
+	mu      sync.Mutex
+	conns   []net.Conn
+	stalled atomic.Bool
+	// dropCommands severs the connections whenever the
+	// initiator sends a SCSI command
+	dropCommands atomic.Bool
+}
+
+func runTCPProxy(t testing.TB, backend string) *tcpProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &tcpProxy{l: l}
+	t.Cleanup(func() {
+		_ = l.Close()
+		p.drop()
+	})
+	go func() {
+		for {
+			client, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server, err := net.Dial("tcp", backend)
+			if err != nil {
+				_ = client.Close()
+				continue
+			}
+			p.mu.Lock()
+			p.conns = append(p.conns, client, server)
+			p.mu.Unlock()
+			go p.forward(server, client, true)
+			go p.forward(client, server, false)
+		}
+	}()
+	return p
+}
+
+func (p *tcpProxy) forward(dst, src net.Conn, fromInitiator bool) {
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := src.Read(buf)
+		if err != nil {
+			return
+		}
+		// libiscsi writes each PDU header in one go, so the read
+		// starts with the opcode of the next one
+		if fromInitiator && p.dropCommands.Load() && buf[0]&0x3f == iscsiOpSCSICommand {
+			p.drop()
+			return
+		}
+		if p.stalled.Load() {
+			continue
+		}
+		if _, err := dst.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// the opcode of a SCSI Command PDU
+const iscsiOpSCSICommand = 0x01
+
+func (p *tcpProxy) drop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, c := range p.conns {
+		_ = c.Close()
+	}
+	p.conns = nil
+}
+
+// proxiedTargetURL rewrites the portal of a test target url
+// to go through p instead
+func proxiedTargetURL(t testing.TB, targetURL string, p *tcpProxy) string {
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Replace(targetURL, u.Host, p.l.Addr().String(), 1)
+}
+
+func TestRecoverAfterConnectionDrop(t *testing.T) {
+	targetURL := createAndRunTestTarget(t, 1*MiB)
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := runTCPProxy(t, u.Host)
+
+	var recoveries []error
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    proxiedTargetURL(t, targetURL, proxy),
+		OnRecovery: func(cause, err error) {
+			assert.Assert(t, errors.Is(cause, iscsi.ErrConnectionLost), cause)
+			recoveries = append(recoveries, err)
+		},
+	})
+	err = device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	write := make([]byte, 512)
+	copy(write, []byte("before failover"))
+	err = device.Write16(iscsi.Write16{LBA: 0, Data: write, BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	proxy.drop()
+
+	// libiscsi may notice the dropped connection and reconnect by itself,
+	// otherwise the device recovers the session, either way the read
+	// should succeed without the caller doing anything
+	data, err := device.Read16(iscsi.Read16{LBA: 0, Blocks: 1, BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(data[:15]), "before failover")
+	for _, err := range recoveries {
+		assert.NilError(t, err)
+	}
+}
+
+func TestRetryPolicy(t *testing.T) {
+	// nothing is listening on this port
+	port := freeport.GetOne(t)
+	var retries []uint
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    fmt.Sprintf("iscsi://127.0.0.1:%d/iqn.2024-10.com.example:0:0/0", port),
+		RetryPolicy: iscsi.RetryPolicy{
+			Attempts: 3,
+			Delay:    time.Millisecond,
+			OnRetry: func(attempt uint, err error) {
+				retries = append(retries, attempt)
+			},
+		},
+	})
+	err := device.Connect()
+	assert.Assert(t, err != nil)
+	assert.DeepEqual(t, retries, []uint{1, 2})
+
+	retries = nil
+	device = iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    fmt.Sprintf("iscsi://127.0.0.1:%d/iqn.2024-10.com.example:0:0/0", port),
+		RetryPolicy: iscsi.RetryPolicy{
+			Attempts:  3,
+			Retryable: func(error) bool { return false },
+			OnRetry: func(attempt uint, err error) {
+				retries = append(retries, attempt)
+			},
+		},
+	})
+	err = device.Connect()
+	assert.Assert(t, err != nil)
+	assert.Equal(t, len(retries), 0)
+}
+
+func TestReissueLimit(t *testing.T) {
+	targetURL := createAndRunTestTarget(t, 1*MiB)
+	u, err := url.Parse(targetURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := runTCPProxy(t, u.Host)
+
+	recoveries := 0
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    proxiedTargetURL(t, targetURL, proxy),
+		RetryPolicy:  iscsi.RetryPolicy{Delay: time.Millisecond},
+		OnRecovery: func(cause, err error) {
+			assert.Check(t, err == nil, err)
+			recoveries++
+		},
+	})
+	err = device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	// logins get through but every command loses the connection
+	proxy.dropCommands.Store(true)
+	_, err = device.ReadCapacity16()
+	assert.Assert(t, errors.Is(err, iscsi.ErrConnectionLost), err)
+	// the first attempt and then 5 reissues
+	assert.Equal(t, recoveries, 6)
+
+	// the session was left recovered
+	proxy.dropCommands.Store(false)
+	_, err = device.ReadCapacity16()
+	assert.NilError(t, err)
+}
@@ -0,0 +1,315 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"unsafe"
+)
+
+// ReservationType is the kind of persistent reservation held on a LUN
+type ReservationType int
+
+const (
+	// only the reservation holder may write
+	ReservationWriteExclusive ReservationType = C.SCSI_PERSISTENT_RESERVE_TYPE_WRITE_EXCLUSIVE
+	// only the reservation holder may read or write
+	ReservationExclusiveAccess ReservationType = C.SCSI_PERSISTENT_RESERVE_TYPE_EXCLUSIVE_ACCESS
+	// only registered initiators may write, one of them holds the
+	// reservation
+	ReservationWriteExclusiveRegistrantsOnly ReservationType = C.SCSI_PERSISTENT_RESERVE_TYPE_WRITE_EXCLUSIVE_REGISTRANTS_ONLY
+	// only registered initiators may read or write, one of them holds
+	// the reservation
+	ReservationExclusiveAccessRegistrantsOnly ReservationType = C.SCSI_PERSISTENT_RESERVE_TYPE_EXCLUSIVE_ACCESS_REGISTRANTS_ONLY
+	// only registered initiators may write, all of them hold the
+	// reservation
+	ReservationWriteExclusiveAllRegistrants ReservationType = C.SCSI_PERSISTENT_RESERVE_TYPE_WRITE_EXCLUSIVE_ALL_REGISTRANTS
+	// only registered initiators may read or write, all of them hold
+	// the reservation
+	ReservationExclusiveAccessAllRegistrants ReservationType = C.SCSI_PERSISTENT_RESERVE_TYPE_EXCLUSIVE_ACCESS_ALL_REGISTRANTS
+)
+
+func (t ReservationType) String() string {
+	switch t {
+	case ReservationWriteExclusive:
+		return "Write Exclusive"
+	case ReservationExclusiveAccess:
+		return "Exclusive Access"
+	case ReservationWriteExclusiveRegistrantsOnly:
+		return "Write Exclusive - Registrants Only"
+	case ReservationExclusiveAccessRegistrantsOnly:
+		return "Exclusive Access - Registrants Only"
+	case ReservationWriteExclusiveAllRegistrants:
+		return "Write Exclusive - All Registrants"
+	case ReservationExclusiveAccessAllRegistrants:
+		return "Exclusive Access - All Registrants"
+	}
+	return fmt.Sprintf("reservation type 0x%x", int(t))
+}
+
+// how much PERSISTENT RESERVE IN data we ask for, enough for
+// over a thousand registered keys
+const persistentReserveInLen = 8192
+
+// RegisteredKeys is the result of READ KEYS
+type RegisteredKeys struct {
+	// Generation is incremented by the target every time the
+	// registrations change
+	Generation uint32
+	Keys       []uint64
+}
+
+// Reservation is the result of READ RESERVATION
+type Reservation struct {
+	Generation uint32
+	// Reserved is false when no reservation is held, in which case
+	// the other fields are zero
+	Reserved bool
+	Key      uint64
+	Scope    int
+	Type     ReservationType
+}
+
+// ReservationCapabilities is the result of REPORT CAPABILITIES
+type ReservationCapabilities struct {
+	// ReplaceLostReservation (RLR_C) is set when the target
+	// replaces lost reservations
+	ReplaceLostReservation bool
+	// CompatibleReservationHandling (CRH) is set when RESERVE(6)
+	// and RELEASE(6) are handled as described in SPC-3
+	CompatibleReservationHandling bool
+	// SpecifyInitiatorPorts (SIP_C) is set when SPEC_I_PT
+	// is supported
+	SpecifyInitiatorPorts bool
+	// AllTargetPorts (ATP_C) is set when ALL_TG_PT is supported
+	AllTargetPorts bool
+	// PersistThroughPowerLoss (PTPL_C) is set when APTPL is
+	// supported, and PersistThroughPowerLossActive (PTPL_A) when
+	// it's currently in effect
+	PersistThroughPowerLoss       bool
+	PersistThroughPowerLossActive bool
+	AllowCommands                 int
+	// Types is the reservation types the target supports, only
+	// filled in if it reports them
+	Types []ReservationType
+}
+
+// Register registers key for this I_T nexus, replacing any key that
+// was already registered
+func (d *device) Register(key uint64) error {
+	return d.RegisterContext(context.Background(), key)
+}
+
+func (d *device) RegisterContext(ctx context.Context, key uint64) error {
+	return d.persistentReserveOut(ctx, C.SCSI_PERSISTENT_RESERVE_REGISTER_AND_IGNORE_EXISTING_KEY, 0,
+		C.struct_scsi_persistent_reserve_out_basic{service_action_reservation_key: C.uint64_t(key)})
+}
+
+// Unregister removes the registration of key, releasing any
+// reservation it holds
+func (d *device) Unregister(key uint64) error {
+	return d.UnregisterContext(context.Background(), key)
+}
+
+func (d *device) UnregisterContext(ctx context.Context, key uint64) error {
+	return d.persistentReserveOut(ctx, C.SCSI_PERSISTENT_RESERVE_REGISTER, 0,
+		C.struct_scsi_persistent_reserve_out_basic{reservation_key: C.uint64_t(key)})
+}
+
+// Reserve takes a reservation of type t with a key that has
+// already been registered
+func (d *device) Reserve(key uint64, t ReservationType) error {
+	return d.ReserveContext(context.Background(), key, t)
+}
+
+func (d *device) ReserveContext(ctx context.Context, key uint64, t ReservationType) error {
+	return d.persistentReserveOut(ctx, C.SCSI_PERSISTENT_RESERVE_RESERVE, t,
+		C.struct_scsi_persistent_reserve_out_basic{reservation_key: C.uint64_t(key)})
+}
+
+// Release gives up a reservation held with key.  t must match the type
+// the reservation was taken with
+func (d *device) Release(key uint64, t ReservationType) error {
+	return d.ReleaseContext(context.Background(), key, t)
+}
+
+func (d *device) ReleaseContext(ctx context.Context, key uint64, t ReservationType) error {
+	return d.persistentReserveOut(ctx, C.SCSI_PERSISTENT_RESERVE_RELEASE, t,
+		C.struct_scsi_persistent_reserve_out_basic{reservation_key: C.uint64_t(key)})
+}
+
+// Preempt removes the registrations of victim, taking over the
+// reservation if victim held it
+func (d *device) Preempt(key, victim uint64, t ReservationType) error {
+	return d.PreemptContext(context.Background(), key, victim, t)
+}
+
+func (d *device) PreemptContext(ctx context.Context, key, victim uint64, t ReservationType) error {
+	return d.persistentReserveOut(ctx, C.SCSI_PERSISTENT_RESERVE_PREEMPT, t,
+		C.struct_scsi_persistent_reserve_out_basic{
+			reservation_key:                C.uint64_t(key),
+			service_action_reservation_key: C.uint64_t(victim),
+		})
+}
+
+// PreemptAndAbort is Preempt that also aborts any commands the
+// preempted initiators have outstanding
+func (d *device) PreemptAndAbort(key, victim uint64, t ReservationType) error {
+	return d.PreemptAndAbortContext(context.Background(), key, victim, t)
+}
+
+func (d *device) PreemptAndAbortContext(ctx context.Context, key, victim uint64, t ReservationType) error {
+	return d.persistentReserveOut(ctx, C.SCSI_PERSISTENT_RESERVE_PREEMPT_AND_ABORT, t,
+		C.struct_scsi_persistent_reserve_out_basic{
+			reservation_key:                C.uint64_t(key),
+			service_action_reservation_key: C.uint64_t(victim),
+		})
+}
+
+// Clear releases any reservation and removes every registration on the
+// LUN.  key must be registered
+func (d *device) Clear(key uint64) error {
+	return d.ClearContext(context.Background(), key)
+}
+
+func (d *device) ClearContext(ctx context.Context, key uint64) error {
+	return d.persistentReserveOut(ctx, C.SCSI_PERSISTENT_RESERVE_CLEAR, 0,
+		C.struct_scsi_persistent_reserve_out_basic{reservation_key: C.uint64_t(key)})
+}
+
+// persistentReserveOut sends PERSISTENT RESERVE OUT.  A conflicting
+// reservation comes back as a *SCSIError matching ErrReservationConflict
+func (d *device) persistentReserveOut(ctx context.Context, sa int, t ReservationType, params C.struct_scsi_persistent_reserve_out_basic) error {
+	logger().Debug("PersistentReserveOut", slog.Int("sa", sa), slog.Any("type", t))
+	// preempting in particular can't be repeated safely
+	task, err := d.runTaskOnce(ctx, "iscsi_persistent_reserve_out_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		// libiscsi copies the parameters into the task
+		return C.iscsi_persistent_reserve_out_task(d.root().Context, C.int(d.targetLun), C.int(sa),
+			C.SCSI_PERSISTENT_RESERVE_SCOPE_LU, C.int(t), unsafe.Pointer(&params), cb, pdata)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
+func (d *device) persistentReserveIn(ctx context.Context, sa int) ([]byte, error) {
+	task, err := d.runIdempotentTask(ctx, "iscsi_persistent_reserve_in_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_persistent_reserve_in_task(d.root().Context, C.int(d.targetLun), C.int(sa), persistentReserveInLen, cb, pdata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.scsi_free_scsi_task(task)
+	return C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size), nil
+}
+
+func (d *device) ReadKeys() (RegisteredKeys, error) {
+	return d.ReadKeysContext(context.Background())
+}
+
+func (d *device) ReadKeysContext(ctx context.Context) (RegisteredKeys, error) {
+	data, err := d.persistentReserveIn(ctx, C.SCSI_PERSISTENT_RESERVE_READ_KEYS)
+	if err != nil {
+		return RegisteredKeys{}, err
+	}
+	return parseReadKeys(data)
+}
+
+func parseReadKeys(data []byte) (RegisteredKeys, error) {
+	if len(data) < 8 {
+		return RegisteredKeys{}, fmt.Errorf("READ KEYS: short data (%d bytes)", len(data))
+	}
+	keys := RegisteredKeys{Generation: binary.BigEndian.Uint32(data[0:4])}
+	end := min(8+int(binary.BigEndian.Uint32(data[4:8])), len(data))
+	for off := 8; off+8 <= end; off += 8 {
+		keys.Keys = append(keys.Keys, binary.BigEndian.Uint64(data[off:off+8]))
+	}
+	return keys, nil
+}
+
+func (d *device) ReadReservation() (Reservation, error) {
+	return d.ReadReservationContext(context.Background())
+}
+
+func (d *device) ReadReservationContext(ctx context.Context) (Reservation, error) {
+	data, err := d.persistentReserveIn(ctx, C.SCSI_PERSISTENT_RESERVE_READ_RESERVATION)
+	if err != nil {
+		return Reservation{}, err
+	}
+	return parseReadReservation(data)
+}
+
+func parseReadReservation(data []byte) (Reservation, error) {
+	if len(data) < 8 {
+		return Reservation{}, fmt.Errorf("READ RESERVATION: short data (%d bytes)", len(data))
+	}
+	r := Reservation{Generation: binary.BigEndian.Uint32(data[0:4])}
+	if binary.BigEndian.Uint32(data[4:8]) == 0 {
+		return r, nil
+	}
+	if len(data) < 24 {
+		return r, fmt.Errorf("READ RESERVATION: short data (%d bytes)", len(data))
+	}
+	r.Reserved = true
+	r.Key = binary.BigEndian.Uint64(data[8:16])
+	r.Scope = int(data[21] >> 4)
+	r.Type = ReservationType(data[21] & 0x0f)
+	return r, nil
+}
+
+func (d *device) ReportCapabilities() (ReservationCapabilities, error) {
+	return d.ReportCapabilitiesContext(context.Background())
+}
+
+func (d *device) ReportCapabilitiesContext(ctx context.Context) (ReservationCapabilities, error) {
+	data, err := d.persistentReserveIn(ctx, C.SCSI_PERSISTENT_RESERVE_REPORT_CAPABILITIES)
+	if err != nil {
+		return ReservationCapabilities{}, err
+	}
+	return parseReportCapabilities(data)
+}
+
+func parseReportCapabilities(data []byte) (ReservationCapabilities, error) {
+	if len(data) < 8 {
+		return ReservationCapabilities{}, fmt.Errorf("REPORT CAPABILITIES: short data (%d bytes)", len(data))
+	}
+	c := ReservationCapabilities{
+		ReplaceLostReservation:        data[2]&0x80 != 0,
+		CompatibleReservationHandling: data[2]&0x10 != 0,
+		SpecifyInitiatorPorts:         data[2]&0x08 != 0,
+		AllTargetPorts:                data[2]&0x04 != 0,
+		PersistThroughPowerLoss:       data[2]&0x01 != 0,
+		AllowCommands:                 int(data[3]>>4) & 0x07,
+		PersistThroughPowerLossActive: data[3]&0x01 != 0,
+	}
+	// TMV says whether the type mask is valid
+	if data[3]&0x80 != 0 {
+		mask := []struct {
+			b, bit int
+			t      ReservationType
+		}{
+			{4, 0x02, ReservationWriteExclusive},
+			{4, 0x08, ReservationExclusiveAccess},
+			{4, 0x20, ReservationWriteExclusiveRegistrantsOnly},
+			{4, 0x40, ReservationExclusiveAccessRegistrantsOnly},
+			{4, 0x80, ReservationWriteExclusiveAllRegistrants},
+			{5, 0x01, ReservationExclusiveAccessAllRegistrants},
+		}
+		for _, m := range mask {
+			if int(data[m.b])&m.bit != 0 {
+				c.Types = append(c.Types, m.t)
+			}
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,70 @@
+package iscsi_test
+
+import (
+	"errors"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestPersistentReservations(t *testing.T) {
+	url := createAndRunTestTarget(t, 1*MiB)
+	a := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go-a",
+		TargetURL:    url,
+	})
+	b := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go-b",
+		TargetURL:    url,
+	})
+	err := a.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = b.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = a.Disconnect()
+		_ = b.Disconnect()
+	}()
+	const keyA, keyB = 0xaaaa, 0xbbbb
+
+	caps, err := a.ReportCapabilities()
+	assert.NilError(t, err)
+	t.Logf("capabilities: %+v", caps)
+
+	res, err := a.ReadReservation()
+	assert.NilError(t, err)
+	assert.Assert(t, !res.Reserved)
+
+	assert.NilError(t, a.Register(keyA))
+	assert.NilError(t, a.Reserve(keyA, iscsi.ReservationWriteExclusive))
+	assert.NilError(t, b.Register(keyB))
+
+	res, err = b.ReadReservation()
+	assert.NilError(t, err)
+	assert.Assert(t, res.Reserved)
+	assert.Equal(t, res.Key, uint64(keyA))
+	assert.Equal(t, res.Type, iscsi.ReservationWriteExclusive)
+
+	err = b.Reserve(keyB, iscsi.ReservationWriteExclusive)
+	assert.Assert(t, errors.Is(err, iscsi.ErrReservationConflict), "got %v", err)
+
+	assert.NilError(t, b.Preempt(keyB, keyA, iscsi.ReservationWriteExclusive))
+	res, err = a.ReadReservation()
+	assert.NilError(t, err)
+	assert.Assert(t, res.Reserved)
+	assert.Equal(t, res.Key, uint64(keyB))
+
+	// a's registration went with the preempt
+	err = a.Release(keyA, iscsi.ReservationWriteExclusive)
+	assert.Assert(t, errors.Is(err, iscsi.ErrReservationConflict), "got %v", err)
+
+	assert.NilError(t, b.Clear(keyB))
+	res, err = a.ReadReservation()
+	assert.NilError(t, err)
+	assert.Assert(t, !res.Reserved)
+}
@@ -0,0 +1,475 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	gopointer "github.com/mattn/go-pointer"
+	"golang.org/x/sys/unix"
+)
+
+// ErrSessionClosed is returned for commands submitted to a Session
+// after Close has been called
+var ErrSessionClosed = errors.New("iscsi session closed")
+
+// the default for ConnectionDetails.MaxInFlight
+const defaultMaxInFlight = 32
+
+// Session is a logged in connection to a LUN that is safe to use
+// from multiple goroutines.  The libiscsi context is owned by a
+// single event loop goroutine; commands from callers are queued
+// for that goroutine, multiplexed onto the connection and their
+// completions handed back to the goroutine that submitted them.
+//
+// ConnectionDetails.MaxInFlight caps the number of commands outstanding
+// on the connection, the rest wait in the submission queue.  libiscsi
+// also holds back commands that fall outside the CmdSN window granted
+// by the target so this only needs to bound memory and fairness.
+//
+// Reads and writes are split to fit the target's transfer limits like
+// they are for a device.  A Session has no recovery of its own though, a
+// dropped connection is left to libiscsi's automatic reconnect and if
+// servicing the connection fails the session stops.  Every command after
+// that fails with the error it stopped with, which wraps
+// ErrConnectionLost, and a new Session has to be created
+type Session struct {
+	dev         *device
+	maxInFlight int
+	limits      BlockLimits
+
+	// wakeR and wakeW are a self-pipe used to interrupt the event loop's
+	// poll when there is new work for it
+	wakeR, wakeW int
+
+	mu         sync.Mutex
+	queue      []*sessionRequest
+	cancels    []*sessionRequest
+	closing    bool
+	pipeClosed bool
+	// err is the reason the event loop stopped, set before done is closed
+	err  error
+	done chan struct{}
+
+	// only touched by the event loop goroutine
+	inflight map[*sessionRequest]struct{}
+}
+
+type sessionRequest struct {
+	ctx  context.Context
+	name string
+	// start issues the task on the event loop goroutine
+	start func(d *device, cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task
+	// finish, if set, runs on the event loop goroutine when the task
+	// completes with a GOOD status and should copy out anything the
+	// caller needs before the task is freed
+	finish func(task *C.struct_scsi_task) error
+	// pinner keeps any Go memory handed to libiscsi in place until the
+	// task completes
+	pinner runtime.Pinner
+	result chan error
+
+	session *Session
+	task    *C.struct_scsi_task
+	pdata   unsafe.Pointer
+}
+
+// NewSession connects to the target described by details and starts
+// the event loop goroutine that services the connection
+func NewSession(ctx context.Context, details ConnectionDetails) (*Session, error) {
+	dev := New(details)
+	dev.loopOwned = true
+	if err := dev.ConnectContext(ctx); err != nil {
+		return nil, err
+	}
+	// the block limits are fetched up front, once the event loop owns
+	// the connection nothing else can issue commands on it
+	limits, err := dev.cachedBlockLimits(ctx)
+	if err != nil {
+		_ = dev.Disconnect()
+		return nil, err
+	}
+	s := &Session{
+		dev:         dev,
+		maxInFlight: dev.maxInFlight(),
+		limits:      limits,
+		done:        make(chan struct{}),
+		inflight:    map[*sessionRequest]struct{}{},
+	}
+	fds := make([]int, 2)
+	if err := unix.Pipe(fds); err != nil {
+		_ = dev.Disconnect()
+		return nil, fmt.Errorf("unable to create wakeup pipe: %w", err)
+	}
+	s.wakeR, s.wakeW = fds[0], fds[1]
+	for _, fd := range fds {
+		if err := unix.SetNonblock(fd, true); err != nil {
+			_ = dev.Disconnect()
+			s.closePipe()
+			return nil, fmt.Errorf("unable to create wakeup pipe: %w", err)
+		}
+	}
+	go s.run()
+	return s, nil
+}
+
+// Close fails any queued commands with ErrSessionClosed, cancels the
+// ones in flight, logs out and waits for the event loop to stop
+func (s *Session) Close() error {
+	s.mu.Lock()
+	s.closing = true
+	s.mu.Unlock()
+	s.wakeup()
+	<-s.done
+
+	s.mu.Lock()
+	if !s.pipeClosed {
+		s.pipeClosed = true
+		s.closePipe()
+	}
+	s.mu.Unlock()
+	if errors.Is(s.err, ErrSessionClosed) {
+		return nil
+	}
+	return s.err
+}
+
+func (s *Session) ReadCapacity10(ctx context.Context) (c Capacity, err error) {
+	var readcapacity C.struct_scsi_readcapacity10
+	err = s.do(&sessionRequest{
+		ctx:  ctx,
+		name: "iscsi_readcapacity10_task",
+		start: func(d *device, cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+			return C.iscsi_readcapacity10_task(d.Context, C.int(d.targetLun), 0, 0, cb, pdata)
+		},
+		finish: func(task *C.struct_scsi_task) (err error) {
+			readcapacity, err = getReadCapacity10(*task)
+			return err
+		},
+	})
+	if err != nil {
+		return c, err
+	}
+	return capacity10(readcapacity), nil
+}
+
+func (s *Session) ReadCapacity16(ctx context.Context) (c Capacity, err error) {
+	var readcapacity C.struct_scsi_readcapacity16
+	err = s.do(&sessionRequest{
+		ctx:  ctx,
+		name: "iscsi_readcapacity16_task",
+		start: func(d *device, cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+			return C.iscsi_readcapacity16_task(d.Context, C.int(d.targetLun), cb, pdata)
+		},
+		finish: func(task *C.struct_scsi_task) (err error) {
+			readcapacity, err = getReadCapacity16(*task)
+			return err
+		},
+	})
+	if err != nil {
+		return c, err
+	}
+	return capacity16(readcapacity), nil
+}
+
+// Read16 returns a *ShortTransferError along with whatever data did
+// arrive if the target sends fewer blocks than were asked for
+func (s *Session) Read16(ctx context.Context, data Read16) ([]byte, error) {
+	if data.BlockSize <= 0 || data.Blocks <= 0 {
+		return nil, fmt.Errorf("Read16: invalid read of %d blocks of %d bytes", data.Blocks, data.BlockSize)
+	}
+	maxBlocks := transferLimit(s.limits, data.BlockSize, libiscsiMaxBurstLength)
+	return readChunked(data.Blocks, data.BlockSize, maxBlocks, func(done, blocks int) ([]byte, error) {
+		return s.read16(ctx, data.LBA+done, blocks, data.BlockSize)
+	})
+}
+
+// read16 sends a single READ(16) that fits within the target's
+// transfer limits
+func (s *Session) read16(ctx context.Context, lba, blocks, blockSize int) ([]byte, error) {
+	var read []byte
+	err := s.do(&sessionRequest{
+		ctx:  ctx,
+		name: "iscsi_read16_task",
+		start: func(d *device, cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+			return C.iscsi_read16_task(
+				d.Context, C.int(d.targetLun), C.uint64_t(lba),
+				C.uint(blockSize*blocks), C.int(blockSize),
+				0, 0, 0, 0, 0, cb, pdata,
+			)
+		},
+		finish: func(task *C.struct_scsi_task) error {
+			want := blockSize * blocks
+			read = dataIn(task, want)
+			if len(read) < want {
+				return &ShortTransferError{Op: "iscsi_read16_task", Expected: want, Transferred: len(read)}
+			}
+			return nil
+		},
+	})
+	return read, err
+}
+
+func (s *Session) Write16(ctx context.Context, data Write16) error {
+	if data.BlockSize <= 0 || len(data.Data) == 0 || len(data.Data)%data.BlockSize != 0 {
+		return fmt.Errorf("Write16: data must be a multiple of the %d byte block size", data.BlockSize)
+	}
+	chunk := transferLimit(s.limits, data.BlockSize, libiscsiMaxBurstLength) * data.BlockSize
+	for off := 0; off < len(data.Data); off += chunk {
+		end := min(off+chunk, len(data.Data))
+		if err := s.write16(ctx, data.LBA+off/data.BlockSize, data.Data[off:end], data.BlockSize, data.FUA); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write16 sends a single WRITE(16) that fits within the target's
+// transfer limits
+func (s *Session) write16(ctx context.Context, lba int, data []byte, blockSize int, fua bool) error {
+	req := &sessionRequest{
+		ctx:  ctx,
+		name: "iscsi_write16_task",
+		start: func(d *device, cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+			return C.iscsi_write16_task(
+				d.Context, C.int(d.targetLun), C.uint64_t(lba),
+				(*C.uchar)(unsafe.Pointer(&data[0])), C.uint(len(data)),
+				C.int(blockSize), 0, 0, cBool(fua), 0, 0, cb, pdata,
+			)
+		},
+	}
+	// libiscsi holds on to the buffer until the data has been sent
+	req.pinner.Pin(&data[0])
+	return s.do(req)
+}
+
+// do queues req for the event loop and waits for it to complete.  If
+// req.ctx is done first the task is aborted, and do still waits for
+// the event loop to let go of it so that any memory the caller handed
+// to libiscsi can safely be reused once do returns
+func (s *Session) do(req *sessionRequest) error {
+	defer req.pinner.Unpin()
+	if err := req.ctx.Err(); err != nil {
+		return fmt.Errorf("%s: %w", req.name, err)
+	}
+	req.session = s
+	req.result = make(chan error, 1)
+
+	s.mu.Lock()
+	if s.closing {
+		// err is the reason the event loop stopped, if it has
+		err := s.err
+		s.mu.Unlock()
+		if err == nil {
+			err = ErrSessionClosed
+		}
+		return err
+	}
+	s.queue = append(s.queue, req)
+	s.mu.Unlock()
+	s.wakeup()
+
+	select {
+	case err := <-req.result:
+		return err
+	case <-req.ctx.Done():
+	}
+	s.mu.Lock()
+	// once the session is closing the event loop fails everything
+	// outstanding on its own
+	if !s.closing {
+		s.cancels = append(s.cancels, req)
+	}
+	s.mu.Unlock()
+	s.wakeup()
+	<-req.result
+	return fmt.Errorf("%s: %w", req.name, req.ctx.Err())
+}
+
+func (s *Session) wakeup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pipeClosed {
+		return
+	}
+	// a full pipe already guarantees a wakeup so errors can be ignored
+	_, _ = unix.Write(s.wakeW, []byte{0})
+}
+
+func (s *Session) closePipe() {
+	_ = unix.Close(s.wakeR)
+	_ = unix.Close(s.wakeW)
+}
+
+func (s *Session) run() {
+	defer close(s.done)
+	drain := make([]byte, 64)
+	for {
+		s.mu.Lock()
+		closing := s.closing
+		cancels := s.cancels
+		s.cancels = nil
+		s.mu.Unlock()
+
+		if closing {
+			s.shutdown(ErrSessionClosed)
+			return
+		}
+		for _, req := range cancels {
+			s.cancel(req)
+		}
+		s.startQueued()
+
+		fds := []unix.PollFd{
+			{Fd: int32(s.dev.GetFD()), Events: int16(s.dev.WhichEvents())},
+			{Fd: int32(s.wakeR), Events: unix.POLLIN},
+		}
+		timeout := 1000
+		if k := s.dev.keepalive; k != nil {
+			timeout = min(timeout, int(k.opts.Interval.Milliseconds()))
+		}
+		_, err := unix.Poll(fds, timeout)
+		if err != nil && err != syscall.EINTR {
+			s.shutdown(fmt.Errorf("%w: poll failed: %w", ErrConnectionLost, err))
+			return
+		}
+		if fds[1].Revents&unix.POLLIN != 0 {
+			for {
+				if n, _ := unix.Read(s.wakeR, drain); n < len(drain) {
+					break
+				}
+			}
+		}
+		if s.dev.HandleEvents(fds[0].Revents) < 0 {
+			s.shutdown(fmt.Errorf("%w: failed to handle events: %s", ErrConnectionLost,
+				C.GoString(C.iscsi_get_error(s.dev.Context))))
+			return
+		}
+		if k := s.dev.keepalive; k != nil && k.due(time.Now()) {
+			if err := s.dev.sendKeepalive(); err != nil {
+				s.dev.keepaliveDead(err)
+				s.shutdown(err)
+				return
+			}
+		}
+	}
+}
+
+// KeepaliveStats returns the keepalive round trips so far, or the zero
+// value if keepalives aren't enabled
+func (s *Session) KeepaliveStats() KeepaliveStats {
+	return s.dev.KeepaliveStats()
+}
+
+// startQueued issues queued requests until MaxInFlight is reached
+func (s *Session) startQueued() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.queue) > 0 && len(s.inflight) < s.maxInFlight {
+		req := s.queue[0]
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		if err := req.ctx.Err(); err != nil {
+			req.result <- fmt.Errorf("%s: %w", req.name, err)
+			continue
+		}
+		req.pdata = gopointer.Save(req)
+		req.task = req.start(s.dev, sessionCB, req.pdata)
+		if req.task == nil {
+			gopointer.Unref(req.pdata)
+			req.result <- fmt.Errorf("unable to start %s: %s", req.name,
+				C.GoString(C.iscsi_get_error(s.dev.Context)))
+			continue
+		}
+		s.inflight[req] = struct{}{}
+	}
+}
+
+// cancel aborts an in-flight request on the target and then cancels it
+// in libiscsi, which completes it through the usual callback.  Requests
+// that haven't been started yet are dropped from the queue
+func (s *Session) cancel(req *sessionRequest) {
+	if _, ok := s.inflight[req]; ok {
+		s.dev.abortTask(req.task)
+		// the abort may have raced with the task completing
+		if _, ok := s.inflight[req]; ok {
+			if C.iscsi_scsi_cancel_task(s.dev.Context, req.task) != 0 {
+				// libiscsi no longer knows about the task so
+				// there won't be a callback for it
+				req.complete(C.SCSI_STATUS_CANCELLED)
+			}
+		}
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, queued := range s.queue {
+		if queued == req {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+			req.result <- req.ctx.Err()
+			return
+		}
+	}
+}
+
+// shutdown fails every outstanding request with err and tears down the
+// connection.  It runs on the event loop goroutine as it exits
+func (s *Session) shutdown(err error) {
+	s.mu.Lock()
+	s.closing = true
+	s.err = err
+	queue := s.queue
+	s.queue = nil
+	s.mu.Unlock()
+
+	for _, req := range queue {
+		req.result <- err
+	}
+	// completes every in-flight request with SCSI_STATUS_CANCELLED
+	C.iscsi_scsi_cancel_all_tasks(s.dev.Context)
+	for req := range s.inflight {
+		// anything libiscsi no longer knew about
+		req.complete(C.SCSI_STATUS_CANCELLED)
+	}
+	if disconnectErr := s.dev.Disconnect(); disconnectErr != nil {
+		logger().Warn("error disconnecting session", slog.Any("error", disconnectErr))
+	}
+}
+
+// complete hands the result of a finished task back to the submitter.
+// It runs on the event loop goroutine
+func (r *sessionRequest) complete(status int) {
+	s := r.session
+	var err error
+	if status != C.SCSI_STATUS_GOOD {
+		err = newSCSIError(r.name, s.dev.Context, status, r.task)
+	} else if r.finish != nil {
+		err = r.finish(r.task)
+	}
+	delete(s.inflight, r)
+	C.scsi_free_scsi_task(r.task)
+	gopointer.Unref(r.pdata)
+	r.result <- err
+}
+
+//export iscsiSessionCB
+func iscsiSessionCB(_ iscsiContext, status int, command_data, private_data unsafe.Pointer) {
+	req, ok := gopointer.Restore(private_data).(*sessionRequest)
+	if !ok {
+		return
+	}
+	req.complete(status)
+}
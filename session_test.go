@@ -0,0 +1,118 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestSessionConcurrentReadWrite(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	session, err := iscsi.NewSession(context.Background(), iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 10*MiB),
+		MaxInFlight:  4,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	cap, err := session.ReadCapacity16(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each worker owns a distinct range of blocks so the data read
+	// back should always match what that worker wrote
+	nworkers := 16
+	blocksPerWorker := 64
+	w := sync.WaitGroup{}
+	for i := 0; i < nworkers; i++ {
+		data := make([]byte, blocksPerWorker*cap.BlockSize)
+		_, _ = rnd.Read(data)
+		w.Add(1)
+		go func(lba int, data []byte) {
+			defer w.Done()
+			err := session.Write16(context.Background(), iscsi.Write16{
+				LBA:       lba,
+				Data:      data,
+				BlockSize: cap.BlockSize,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			readBack, err := session.Read16(context.Background(), iscsi.Read16{
+				LBA:       lba,
+				Blocks:    blocksPerWorker,
+				BlockSize: cap.BlockSize,
+			})
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			// FailNow isn't allowed off the test goroutine
+			assert.Check(t, bytes.Equal(data, readBack))
+		}(i*blocksPerWorker, data)
+	}
+	w.Wait()
+}
+
+func TestSessionClosed(t *testing.T) {
+	session, err := iscsi.NewSession(context.Background(), iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 1*MiB),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NilError(t, session.Close())
+
+	_, err = session.ReadCapacity16(context.Background())
+	assert.Assert(t, errors.Is(err, iscsi.ErrSessionClosed), err)
+}
+
+func TestSessionLargeTransfers(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	session, err := iscsi.NewSession(context.Background(), iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 8*MiB),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = session.Close()
+	}()
+
+	// gotgt reports no maximum transfer length, so this is split
+	// into a command per burst
+	data := make([]byte, 5*MiB+512)
+	_, _ = rnd.Read(data)
+	err = session.Write16(context.Background(), iscsi.Write16{LBA: 3, Data: data, BlockSize: 512})
+	assert.NilError(t, err)
+	read, err := session.Read16(context.Background(), iscsi.Read16{LBA: 3, Blocks: len(data) / 512, BlockSize: 512})
+	assert.NilError(t, err)
+	assert.Assert(t, bytes.Equal(read, data))
+
+	err = session.Write16(context.Background(), iscsi.Write16{LBA: 0, Data: make([]byte, 100), BlockSize: 512})
+	assert.ErrorContains(t, err, "multiple of the 512 byte block size")
+	err = session.Write16(context.Background(), iscsi.Write16{LBA: 0, Data: make([]byte, 512)})
+	assert.ErrorContains(t, err, "block size")
+	_, err = session.Read16(context.Background(), iscsi.Read16{LBA: 0, Blocks: 1})
+	assert.ErrorContains(t, err, "invalid read")
+}
@@ -0,0 +1,167 @@
+package iscsi
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+const defaultReadAhead = 8
+
+type StreamOptions struct {
+	// ReadAhead is how many reads to keep in flight, defaults to 8.
+	// It's limited by the connection's MaxInFlight
+	ReadAhead int
+	// ChunkSize is how many bytes each read asks for.  It's rounded
+	// down to whole blocks and defaults to the target's optimal
+	// transfer length, and is never more than its maximum
+	ChunkSize int
+}
+
+// streamReader reads a LUN from start to end, keeping several reads in
+// flight so that throughput isn't limited by the round trip time
+type streamReader struct {
+	dev         *device
+	blocksize   int
+	lba         int
+	chunkBlocks int
+	readAhead   int
+	results     chan TaskResult
+	// next lba to ask the target for
+	nextLBA int
+	// lba of the chunk Read hands out next
+	readLBA int
+	// chunks that completed ahead of readLBA
+	pending  map[int][]byte
+	inFlight int
+	buf      []byte
+	err      error
+}
+
+// StreamReader returns an io.Reader for sequentially reading the whole
+// of a LUN, e.g. for imaging it with io.Copy.  Unlike Reader it doesn't
+// support seeking.  The device must not be used for anything else
+// until the reader is closed
+func StreamReader(dev *device, opts StreamOptions) (*streamReader, error) {
+	c, err := dev.ReadCapacity()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get capacity of device: %w", err)
+	}
+	maxBlocks, err := dev.maxTransferBlocks(context.Background(), c.BlockSize)
+	if err != nil {
+		return nil, err
+	}
+	chunkBlocks := maxBlocks
+	if opts.ChunkSize > 0 {
+		chunkBlocks = min(max(opts.ChunkSize/c.BlockSize, 1), maxBlocks)
+	}
+	readAhead := opts.ReadAhead
+	if readAhead <= 0 {
+		readAhead = defaultReadAhead
+	}
+	readAhead = min(readAhead, dev.maxInFlight())
+	logger().Debug("StreamReader", slog.Int("chunkBlocks", chunkBlocks), slog.Int("readAhead", readAhead))
+	return &streamReader{
+		dev:         dev,
+		blocksize:   c.BlockSize,
+		lba:         c.MaxLBA + 1,
+		chunkBlocks: chunkBlocks,
+		readAhead:   readAhead,
+		// room for every read in flight so the callback never blocks
+		results: make(chan TaskResult, readAhead),
+		pending: map[int][]byte{},
+	}, nil
+}
+
+func (r *streamReader) Read(p []byte) (int, error) {
+	if len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if r.readLBA >= r.lba {
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			r.err = err
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// next waits for the chunk at readLBA, keeping the read ahead
+// queue topped up in the meantime
+func (r *streamReader) next() error {
+	for {
+		for r.inFlight < r.readAhead && r.nextLBA < r.lba {
+			blocks := min(r.chunkBlocks, r.lba-r.nextLBA)
+			_, err := r.dev.Read16Async(Read16{LBA: r.nextLBA, Blocks: blocks, BlockSize: r.blocksize}, r.results)
+			if err != nil {
+				return err
+			}
+			r.inFlight++
+			r.nextLBA += blocks
+		}
+		if err := r.collect(); err != nil {
+			return err
+		}
+		if data, ok := r.pending[r.readLBA]; ok {
+			delete(r.pending, r.readLBA)
+			r.readLBA += len(data) / r.blocksize
+			r.buf = data
+			return nil
+		}
+		if err := r.dev.ProcessAsyncN(1); err != nil {
+			return err
+		}
+	}
+}
+
+// collect moves any completed reads into pending
+func (r *streamReader) collect() error {
+	for {
+		select {
+		case result := <-r.results:
+			r.inFlight--
+			if result.Err != nil {
+				return fmt.Errorf("iscsi device read error: %w", result.Err)
+			}
+			read := result.Context.(Read16)
+			data := result.Task.DataIn
+			if want := read.Blocks * read.BlockSize; len(data) < want {
+				// the target sent less than we asked for, fetch
+				// the rest rather than leave a hole in the stream
+				got := len(data) / read.BlockSize
+				logger().Debug("short read", slog.Int("lba", read.LBA), slog.Int("blocks", got))
+				rest, err := r.dev.Read16(Read16{LBA: read.LBA + got, Blocks: read.Blocks - got, BlockSize: read.BlockSize})
+				if err != nil {
+					return fmt.Errorf("iscsi device read error: %w", err)
+				}
+				data = append(data[:got*read.BlockSize], rest...)
+			}
+			r.pending[read.LBA] = data
+		default:
+			return nil
+		}
+	}
+}
+
+// Close waits for any reads still in flight and disconnects the device
+func (r *streamReader) Close() error {
+	for r.inFlight > 0 {
+		if err := r.collect(); err != nil {
+			// there may be more results behind a failed one
+			continue
+		}
+		if r.inFlight == 0 {
+			break
+		}
+		if err := r.dev.ProcessAsyncN(1); err != nil {
+			break
+		}
+	}
+	return r.dev.Disconnect()
+}
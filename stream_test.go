@@ -0,0 +1,59 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestStreamReader(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	fileName := writeTargetTempfile(t, rnd, 8*MiB+3*512)
+	expected, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		desc string
+		opts iscsi.StreamOptions
+	}{
+		{desc: "defaults"},
+		// lots of small reads so they're likely to complete out of order
+		{desc: "small chunks", opts: iscsi.StreamOptions{ReadAhead: 16, ChunkSize: 4 * KiB}},
+		{desc: "no read ahead", opts: iscsi.StreamOptions{ReadAhead: 1}},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			device := iscsi.New(iscsi.ConnectionDetails{
+				InitiatorIQN: "iqn.2024-10.libiscsi:go",
+				TargetURL:    runTestTarget(t, fileName),
+			})
+			err := device.Connect()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sreader, err := iscsi.StreamReader(device, tC.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer sreader.Close()
+
+			var out bytes.Buffer
+			n, err := io.Copy(&out, sreader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, int(n), len(expected))
+			assert.Assert(t, bytes.Equal(out.Bytes(), expected))
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math"
+	"unsafe"
+)
+
+// Flush asks the target to write everything in its volatile cache to
+// stable storage
+func (d *device) Flush() error {
+	return d.FlushContext(context.Background())
+}
+
+func (d *device) FlushContext(ctx context.Context) error {
+	// a block count of 0 means everything from the lba to
+	// the end of the LUN
+	return d.SynchronizeCache16Context(ctx, 0, 0)
+}
+
+// SynchronizeCache16 flushes blocks starting at lba from the target's
+// cache.  blocks may be 0 to flush through to the end of the LUN
+func (d *device) SynchronizeCache16(lba, blocks int) error {
+	return d.SynchronizeCache16Context(context.Background(), lba, blocks)
+}
+
+func (d *device) SynchronizeCache16Context(ctx context.Context, lba, blocks int) error {
+	logger().Debug("SynchronizeCache16", slog.Int("lba", lba), slog.Int("blocks", blocks))
+	if lba < 0 || blocks < 0 || int64(blocks) > math.MaxUint32 {
+		return errors.New("SynchronizeCache16: invalid range")
+	}
+	task, err := d.runIdempotentTask(ctx, "iscsi_synchronizecache16_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_synchronizecache16_task(d.root().Context, C.int(d.targetLun), C.uint64_t(lba), C.uint32_t(blocks), 0, 0, cb, pdata)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
@@ -0,0 +1,70 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestFlush(t *testing.T) {
+	fileName := createTargetTempfile(t, 1*MiB)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	data := bytes.Repeat([]byte("durable!"), 512/8*4)
+	err = device.Write16(iscsi.Write16{LBA: 10, Data: data, BlockSize: 512, FUA: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.SynchronizeCache16(10, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = device.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileData, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(fileData[10*512:14*512], data))
+}
+
+func TestWriterCloseFlushes(t *testing.T) {
+	fileName := createTargetTempfile(t, 1*MiB)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rw, err := iscsi.ReadWriter(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rw.WriteAt([]byte("hello"), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NilError(t, rw.Close())
+	fileData, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, string(fileData[100:105]), "hello")
+}
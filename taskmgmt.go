@@ -0,0 +1,247 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"unsafe"
+
+	gopointer "github.com/mattn/go-pointer"
+)
+
+// TMFResponse is the target's response to a task management request
+type TMFResponse int
+
+const (
+	TMFFunctionComplete         TMFResponse = C.ISCSI_TMR_FUNC_COMPLETE
+	TMFTaskDoesNotExist         TMFResponse = C.ISCSI_TMR_TASK_DOES_NOT_EXIST
+	TMFLUNDoesNotExist          TMFResponse = C.ISCSI_TMR_LUN_DOES_NOT_EXIST
+	TMFTaskStillAllegiant       TMFResponse = C.ISCSI_TMR_TASK_STILL_ALLEGIANT
+	TMFReassignmentNotSupported TMFResponse = C.ISCSI_TMR_TASK_ALLEGIANCE_REASS_NOT_SUPPORTED
+	TMFNotSupported             TMFResponse = C.ISCSI_TMR_TMF_NOT_SUPPORTED
+	TMFAuthorizationFailed      TMFResponse = C.ISCSI_TMR_FUNC_AUTH_FAILED
+	TMFFunctionRejected         TMFResponse = C.ISCSI_TMR_FUNC_REJECTED
+)
+
+var tmfResponseNames = map[TMFResponse]string{
+	TMFFunctionComplete:         "function complete",
+	TMFTaskDoesNotExist:         "task does not exist",
+	TMFLUNDoesNotExist:          "LUN does not exist",
+	TMFTaskStillAllegiant:       "task still allegiant",
+	TMFReassignmentNotSupported: "task allegiance reassignment not supported",
+	TMFNotSupported:             "task management function not supported",
+	TMFAuthorizationFailed:      "function authorization failed",
+	TMFFunctionRejected:         "function rejected",
+}
+
+func (r TMFResponse) String() string {
+	if name, ok := tmfResponseNames[r]; ok {
+		return name
+	}
+	return fmt.Sprintf("TMF response 0x%x", int(r))
+}
+
+// TaskHandle refers to a command started with one of the async APIs,
+// such as Read16Async, until its result has been delivered
+type TaskHandle struct {
+	// dev is the device (or LUN handle) that issued the command
+	dev  *device
+	op   string
+	task *C.struct_scsi_task
+}
+
+// Done reports whether the command's result has been delivered, after
+// which there's nothing left to abort
+func (h *TaskHandle) Done() bool {
+	root := h.dev.root()
+	root.connMu.Lock()
+	defer root.connMu.Unlock()
+	return h.done()
+}
+
+// done is Done for callers that already hold connMu
+func (h *TaskHandle) done() bool {
+	return h.task == nil
+}
+
+// LUN is the logical unit the command was sent to
+func (h *TaskHandle) LUN() int {
+	return h.dev.targetLun
+}
+
+type taskMgmtState struct {
+	syncCallbackState
+	response TMFResponse
+}
+
+// AbortTask asks the target to abort a command started with one of the
+// async APIs.  Once the target has let go of it the command is cancelled
+// locally, so its TaskResult is delivered with StatusCancelled unless it
+// had already completed.  Aborting a command whose result has already
+// been delivered returns TMFTaskDoesNotExist without asking the target
+func (d *device) AbortTask(h *TaskHandle) (TMFResponse, error) {
+	return d.AbortTaskContext(context.Background(), h)
+}
+
+func (d *device) AbortTaskContext(ctx context.Context, h *TaskHandle) (TMFResponse, error) {
+	root := d.root()
+	if h.dev.root() != root {
+		return 0, errors.New("AbortTask: task was started on a different session")
+	}
+	root.connMu.Lock()
+	defer root.connMu.Unlock()
+	if h.done() {
+		return TMFTaskDoesNotExist, nil
+	}
+	resp, err := d.taskMgmt(ctx, "iscsi_task_mgmt_abort_task_async", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_task_mgmt_abort_task_async(d.root().Context, h.task, cb, pdata)
+	})
+	if err != nil {
+		return resp, err
+	}
+	// the response may have come in while we were waiting
+	if !h.done() && (resp == TMFFunctionComplete || resp == TMFTaskDoesNotExist) {
+		d.cancelAsync(h)
+	}
+	return resp, nil
+}
+
+// AbortTaskSet aborts every command this session has outstanding on the
+// LUN.  Async commands are cancelled locally once the target has
+// aborted them
+func (d *device) AbortTaskSet() (TMFResponse, error) {
+	return d.AbortTaskSetContext(context.Background())
+}
+
+func (d *device) AbortTaskSetContext(ctx context.Context) (TMFResponse, error) {
+	return d.resetTasks(ctx, "iscsi_task_mgmt_abort_task_set_async", false, func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_task_mgmt_abort_task_set_async(d.root().Context, C.uint32_t(d.targetLun), cb, pdata)
+	})
+}
+
+// ClearTaskSet aborts every command outstanding on the LUN, including
+// those from other initiators where the target shares one task set
+func (d *device) ClearTaskSet() (TMFResponse, error) {
+	return d.ClearTaskSetContext(context.Background())
+}
+
+func (d *device) ClearTaskSetContext(ctx context.Context) (TMFResponse, error) {
+	return d.resetTasks(ctx, "iscsi_task_mgmt_async", false, func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_task_mgmt_async(d.root().Context, C.int(d.targetLun), C.ISCSI_TM_CLEAR_TASK_SET,
+			0xffffffff, 0, cb, pdata)
+	})
+}
+
+// LUNReset resets the logical unit, aborting every command outstanding on
+// it from any initiator.  Other initiators will see a unit attention on
+// their next command, see WaitReady
+func (d *device) LUNReset() (TMFResponse, error) {
+	return d.LUNResetContext(context.Background())
+}
+
+func (d *device) LUNResetContext(ctx context.Context) (TMFResponse, error) {
+	return d.resetTasks(ctx, "iscsi_task_mgmt_lun_reset_async", false, func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_task_mgmt_lun_reset_async(d.root().Context, C.uint32_t(d.targetLun), cb, pdata)
+	})
+}
+
+// TargetWarmReset resets every logical unit of the target
+func (d *device) TargetWarmReset() (TMFResponse, error) {
+	return d.TargetWarmResetContext(context.Background())
+}
+
+func (d *device) TargetWarmResetContext(ctx context.Context) (TMFResponse, error) {
+	return d.resetTasks(ctx, "iscsi_task_mgmt_target_warm_reset_async", true, func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_task_mgmt_target_warm_reset_async(d.root().Context, cb, pdata)
+	})
+}
+
+// TargetColdReset is TargetWarmReset that also drops every session to
+// the target, this one included.  It will be recovered by the next
+// command unless recovery is disabled
+func (d *device) TargetColdReset() (TMFResponse, error) {
+	return d.TargetColdResetContext(context.Background())
+}
+
+func (d *device) TargetColdResetContext(ctx context.Context) (TMFResponse, error) {
+	return d.resetTasks(ctx, "iscsi_task_mgmt_target_cold_reset_async", true, func(cb C.iscsi_command_cb, pdata unsafe.Pointer) C.int {
+		return C.iscsi_task_mgmt_target_cold_reset_async(d.root().Context, cb, pdata)
+	})
+}
+
+// resetTasks sends a task management request that aborts a whole set of
+// commands.  The target never answers the commands it aborted, so any
+// async ones from this session, on this LUN or on every LUN when
+// allLUNs is set, are cancelled locally
+func (d *device) resetTasks(ctx context.Context, name string, allLUNs bool, start func(C.iscsi_command_cb, unsafe.Pointer) C.int) (TMFResponse, error) {
+	root := d.root()
+	root.connMu.Lock()
+	defer root.connMu.Unlock()
+	resp, err := d.taskMgmt(ctx, name, start)
+	if err != nil || resp != TMFFunctionComplete {
+		return resp, err
+	}
+	// cancelling a task removes it from pending
+	for h := range root.pending {
+		if allLUNs || h.dev.targetLun == d.targetLun {
+			d.cancelAsync(h)
+		}
+	}
+	return resp, nil
+}
+
+// taskMgmt sends a task management request and waits for the target's
+// response.  A response other than TMFFunctionComplete isn't treated as
+// an error, it's up to the caller what to make of it.  The caller must
+// hold connMu
+func (d *device) taskMgmt(ctx context.Context, name string, start func(C.iscsi_command_cb, unsafe.Pointer) C.int) (TMFResponse, error) {
+	logger().Debug("task management", slog.String("function", name), slog.Int("lun", d.targetLun))
+	state := &taskMgmtState{}
+	pdata := gopointer.Save(state)
+	defer gopointer.Unref(pdata)
+	if start(taskMgmtCB, pdata) != 0 {
+		return 0, fmt.Errorf("unable to start %s: %s", name, C.GoString(C.iscsi_get_error(d.root().Context)))
+	}
+	if err := d.eventLoop(ctx, &state.syncCallbackState); err != nil {
+		return 0, fmt.Errorf("error while waiting for %s completion: %w", name, err)
+	}
+	if state.status != C.SCSI_STATUS_GOOD {
+		return 0, fmt.Errorf("%s: %w", name, newSCSIError(name, d.root().Context, state.status, nil))
+	}
+	logger().Debug("task management done", slog.String("function", name), slog.Any("response", state.response))
+	return state.response, nil
+}
+
+// cancelAsync cancels an async command in libiscsi, which delivers its
+// result with StatusCancelled.  Like ProcessAsync this blocks if the
+// command's tasks channel is full.  The caller must hold connMu
+func (d *device) cancelAsync(h *TaskHandle) {
+	if h.done() {
+		return
+	}
+	if C.iscsi_scsi_cancel_task(d.root().Context, h.task) != 0 {
+		logger().Warn("unable to cancel task", slog.String("op", h.op))
+	}
+}
+
+//export iscsiTaskMgmtCB
+func iscsiTaskMgmtCB(_ iscsiContext, status int, command_data, private_data unsafe.Pointer) {
+	state, ok := gopointer.Restore(private_data).(*taskMgmtState)
+	if !ok {
+		return
+	}
+	state.status = status
+	state.finished = true
+	// command_data points to the response code
+	if status == C.SCSI_STATUS_GOOD && command_data != nil {
+		state.response = TMFResponse(*(*C.uint32_t)(command_data))
+	}
+}
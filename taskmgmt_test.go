@@ -0,0 +1,59 @@
+package iscsi_test
+
+import (
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestTaskManagement(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 1*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	results := make(chan iscsi.TaskResult, 1)
+	handle, err := device.Read16Async(iscsi.Read16{LBA: 0, Blocks: 8, BlockSize: 512}, results)
+	assert.NilError(t, err)
+	assert.Assert(t, !handle.Done())
+	// the read may well have finished by the time the target sees the
+	// abort, either way its result is delivered exactly once
+	resp, err := device.AbortTask(handle)
+	assert.NilError(t, err)
+	assert.Assert(t, resp == iscsi.TMFFunctionComplete || resp == iscsi.TMFTaskDoesNotExist, resp)
+	for device.InFlight() > 0 {
+		if err := device.ProcessAsyncN(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	r := <-results
+	assert.Equal(t, r.Handle, handle)
+	assert.Assert(t, handle.Done())
+	assert.Equal(t, len(results), 0)
+
+	resp, err = device.AbortTask(handle)
+	assert.NilError(t, err)
+	assert.Equal(t, resp, iscsi.TMFTaskDoesNotExist)
+
+	resp, err = device.AbortTaskSet()
+	assert.NilError(t, err)
+	assert.Equal(t, resp, iscsi.TMFFunctionComplete)
+	resp, err = device.LUNReset()
+	assert.NilError(t, err)
+	assert.Equal(t, resp, iscsi.TMFFunctionComplete)
+	// gotgt doesn't do target resets
+	resp, err = device.TargetWarmReset()
+	assert.NilError(t, err)
+	assert.Equal(t, resp, iscsi.TMFNotSupported)
+
+	_, err = device.Read16(iscsi.Read16{LBA: 0, Blocks: 1, BlockSize: 512})
+	assert.NilError(t, err)
+}
@@ -0,0 +1,56 @@
+package iscsi
+
+import "context"
+
+// libiscsi offers this MaxBurstLength at login, the target can only
+// negotiate it down.  libiscsi doesn't expose the negotiated value so
+// this is the most a single burst can be.  FirstBurstLength is never
+// larger and libiscsi already limits unsolicited data to it
+const libiscsiMaxBurstLength = 262144
+
+// MaxTransferBlocks returns how many blocks of blockSize bytes a single
+// WRITE(16) queued with Write16Async may carry
+func (d *device) MaxTransferBlocks(blockSize int) (int, error) {
+	return d.MaxTransferBlocksContext(context.Background(), blockSize)
+}
+
+func (d *device) MaxTransferBlocksContext(ctx context.Context, blockSize int) (int, error) {
+	return d.maxTransferBlocks(ctx, blockSize)
+}
+
+// maxTransferBlocks returns how many blocks a single READ or WRITE
+// command may transfer.  It honors the MAXIMUM TRANSFER LENGTH of the
+// Block Limits VPD page, or keeps each command to one burst if the
+// target doesn't report one, see transferLimit
+func (d *device) maxTransferBlocks(ctx context.Context, blockSize int) (int, error) {
+	limits, err := d.cachedBlockLimits(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return transferLimit(limits, blockSize, libiscsiMaxBurstLength), nil
+}
+
+// transferLimit works out the largest number of blocks to send in a
+// single command given the target's limits and the burst length.  A
+// target that reports a MAXIMUM TRANSFER LENGTH takes commands of that
+// size however many bursts they need.  Without one, commands are kept
+// to a single burst since some targets reject sequences spanning several
+// bursts with INVALID FIELD IN INFORMATION UNIT.  The optimal length and
+// granularity are preferences, they only round the limit down so that
+// every command but the last is aligned the way the target likes
+func transferLimit(limits BlockLimits, blockSize, burstLength int) int {
+	if blockSize <= 0 {
+		return 1
+	}
+	blocks := burstLength / blockSize
+	if limits.MaxTransferLength > 0 {
+		blocks = limits.MaxTransferLength
+	}
+	if otl := limits.OptimalTransferLength; otl > 0 && blocks > otl {
+		blocks -= blocks % otl
+	}
+	if g := limits.OptimalTransferLengthGranularity; g > 0 && blocks > g {
+		blocks -= blocks % g
+	}
+	return max(blocks, 1)
+}
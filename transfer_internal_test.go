@@ -0,0 +1,60 @@
+package iscsi
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestTransferLimit(t *testing.T) {
+	const burst = 262144
+	testCases := []struct {
+		desc   string
+		limits BlockLimits
+		want   int
+	}{
+		{
+			desc: "no limits reported",
+			want: burst / 512,
+		},
+		{
+			// 1 MiB commands go out whole rather than per burst
+			desc:   "large max transfer length",
+			limits: BlockLimits{MaxTransferLength: 2048},
+			want:   2048,
+		},
+		{
+			desc:   "small max transfer length",
+			limits: BlockLimits{MaxTransferLength: 64},
+			want:   64,
+		},
+		{
+			// the optimal length only aligns, it doesn't cap
+			desc:   "optimal transfer length",
+			limits: BlockLimits{MaxTransferLength: 2100, OptimalTransferLength: 256},
+			want:   2048,
+		},
+		{
+			desc:   "optimal transfer length above the max",
+			limits: BlockLimits{MaxTransferLength: 2048, OptimalTransferLength: 4096},
+			want:   2048,
+		},
+		{
+			desc:   "granularity",
+			limits: BlockLimits{MaxTransferLength: 1000, OptimalTransferLengthGranularity: 16},
+			want:   992,
+		},
+		{
+			desc:   "granularity without a max",
+			limits: BlockLimits{OptimalTransferLengthGranularity: 48},
+			want:   480,
+		},
+	}
+	for _, tC := range testCases {
+		t.Run(tC.desc, func(t *testing.T) {
+			assert.Equal(t, transferLimit(tC.limits, 512, burst), tC.want)
+		})
+	}
+	assert.Equal(t, transferLimit(BlockLimits{}, 0, burst), 1)
+	assert.Equal(t, transferLimit(BlockLimits{}, 1<<20, burst), 1)
+}
@@ -0,0 +1,49 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestLargeTransfers(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	fileName := createTargetTempfile(t, 8*MiB)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	// far more than fits in a single burst, and not a multiple of one
+	data := make([]byte, 5*MiB+512)
+	_, _ = rnd.Read(data)
+	err = device.Write16(iscsi.Write16{LBA: 3, Data: data, BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileData, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(fileData[3*512:3*512+len(data)], data))
+
+	read, err := device.Read16(iscsi.Read16{LBA: 3, Blocks: len(data) / 512, BlockSize: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(read, data))
+}
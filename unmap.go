@@ -0,0 +1,180 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"unsafe"
+)
+
+// the parameter list length of UNMAP is 16 bits, after the 8 byte header
+// that leaves room for this many 16 byte descriptors
+const maxUnmapDescriptors = (0xffff - 8) / 16
+
+// how much GET LBA STATUS data we ask for, enough for 256 descriptors
+const lbaStatusAllocLen = 8 + 256*16
+
+type LBARange struct {
+	LBA    int
+	Blocks int
+}
+
+// ProvisioningStatus is the provisioning state of an extent reported
+// by GET LBA STATUS
+type ProvisioningStatus int
+
+const (
+	ProvisioningMapped      ProvisioningStatus = 0
+	ProvisioningDeallocated ProvisioningStatus = 1
+	ProvisioningAnchored    ProvisioningStatus = 2
+)
+
+func (s ProvisioningStatus) String() string {
+	switch s {
+	case ProvisioningMapped:
+		return "mapped"
+	case ProvisioningDeallocated:
+		return "deallocated"
+	case ProvisioningAnchored:
+		return "anchored"
+	}
+	return fmt.Sprintf("provisioning status %d", int(s))
+}
+
+type LBAStatusDescriptor struct {
+	LBA    int
+	Blocks int
+	Status ProvisioningStatus
+}
+
+// Unmap tells the target that the blocks in ranges are no longer in use.
+// The ranges are split across as many UNMAP commands as the target's
+// Block Limits VPD page requires
+func (d *device) Unmap(ranges []LBARange) error {
+	return d.UnmapContext(context.Background(), ranges)
+}
+
+func (d *device) UnmapContext(ctx context.Context, ranges []LBARange) error {
+	logger().Debug("Unmap", slog.Int("ranges", len(ranges)))
+	for _, r := range ranges {
+		if r.LBA < 0 || r.Blocks < 0 {
+			return fmt.Errorf("Unmap: invalid range %d+%d", r.LBA, r.Blocks)
+		}
+	}
+	limits, err := d.cachedBlockLimits(ctx)
+	if err != nil {
+		return err
+	}
+	for _, batch := range splitUnmap(ranges, limits) {
+		if err := d.unmap(ctx, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *device) unmap(ctx context.Context, batch []LBARange) error {
+	// libiscsi copies the descriptors into the task so the
+	// slice doesn't need to outlive the call
+	list := make([]C.struct_unmap_list, len(batch))
+	for i, r := range batch {
+		list[i] = C.struct_unmap_list{lba: C.uint64_t(r.LBA), num: C.uint32_t(r.Blocks)}
+	}
+	task, err := d.runIdempotentTask(ctx, "iscsi_unmap_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_unmap_task(d.root().Context, C.int(d.targetLun), 0, 0, &list[0], C.int(len(list)), cb, pdata)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
+// splitUnmap breaks ranges into batches of descriptors that each fit in
+// a single UNMAP command.  A limit of 0 or 0xffffffff means the target
+// didn't report one
+func splitUnmap(ranges []LBARange, limits BlockLimits) [][]LBARange {
+	// counted in int64 so that the 32 bit limit fits on every platform
+	maxLBAs := int64(limits.MaxUnmapLBACount)
+	if maxLBAs <= 0 || maxLBAs > math.MaxUint32 {
+		maxLBAs = math.MaxUint32
+	}
+	maxDescriptors := limits.MaxUnmapBlockDescriptorCount
+	if maxDescriptors <= 0 || maxDescriptors > maxUnmapDescriptors {
+		maxDescriptors = maxUnmapDescriptors
+	}
+
+	var batches [][]LBARange
+	var batch []LBARange
+	var batchLBAs int64
+	for _, r := range ranges {
+		lba, blocks := int64(r.LBA), int64(r.Blocks)
+		for blocks > 0 {
+			if len(batch) == maxDescriptors || batchLBAs == maxLBAs {
+				batches = append(batches, batch)
+				batch, batchLBAs = nil, 0
+			}
+			n := min(blocks, maxLBAs-batchLBAs)
+			batch = append(batch, LBARange{LBA: int(lba), Blocks: int(n)})
+			batchLBAs += n
+			lba += n
+			blocks -= n
+		}
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// GetLBAStatus returns the provisioning status of the extents starting
+// at lba.  The target may describe fewer extents than remain on the
+// LUN, call it again from the end of the last one to get more
+func (d *device) GetLBAStatus(lba int) ([]LBAStatusDescriptor, error) {
+	return d.GetLBAStatusContext(context.Background(), lba)
+}
+
+func (d *device) GetLBAStatusContext(ctx context.Context, lba int) ([]LBAStatusDescriptor, error) {
+	logger().Debug("GetLBAStatus", slog.Int("lba", lba))
+	if lba < 0 {
+		return nil, errors.New("GetLBAStatus: lba must not be negative")
+	}
+	task, err := d.runIdempotentTask(ctx, "iscsi_get_lba_status_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_get_lba_status_task(d.root().Context, C.int(d.targetLun), C.uint64_t(lba), lbaStatusAllocLen, cb, pdata)
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer C.scsi_free_scsi_task(task)
+	return parseLBAStatus(C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size))
+}
+
+func parseLBAStatus(data []byte) ([]LBAStatusDescriptor, error) {
+	if len(data) == 0 {
+		return nil, nil
+	}
+	if len(data) < 8 {
+		return nil, fmt.Errorf("GetLBAStatus: short parameter data (%d bytes)", len(data))
+	}
+	// the length doesn't count itself
+	end := min(int(binary.BigEndian.Uint32(data[0:4]))+4, len(data))
+	var descriptors []LBAStatusDescriptor
+	for off := 8; off+16 <= end; off += 16 {
+		descriptors = append(descriptors, LBAStatusDescriptor{
+			LBA:    int(binary.BigEndian.Uint64(data[off : off+8])),
+			Blocks: int(binary.BigEndian.Uint32(data[off+8 : off+12])),
+			Status: ProvisioningStatus(data[off+12] & 0x0f),
+		})
+	}
+	return descriptors, nil
+}
@@ -0,0 +1,41 @@
+package iscsi
+
+import (
+	"testing"
+
+	"gotest.tools/assert"
+)
+
+func TestSplitUnmap(t *testing.T) {
+	// more ranges than descriptors fit in one command
+	var ranges []LBARange
+	for i := 0; i < 40; i++ {
+		ranges = append(ranges, LBARange{LBA: i * 100, Blocks: 50})
+	}
+	batches := splitUnmap(ranges, BlockLimits{MaxUnmapLBACount: 0, MaxUnmapBlockDescriptorCount: 16})
+	assert.DeepEqual(t, batches, [][]LBARange{ranges[:16], ranges[16:32], ranges[32:]})
+
+	// more blocks than one command may unmap, ranges are split
+	// across commands where the limit falls
+	batches = splitUnmap([]LBARange{{LBA: 0, Blocks: 100}, {LBA: 200, Blocks: 30}},
+		BlockLimits{MaxUnmapLBACount: 64, MaxUnmapBlockDescriptorCount: 16})
+	assert.DeepEqual(t, batches, [][]LBARange{
+		{{LBA: 0, Blocks: 64}},
+		{{LBA: 64, Blocks: 36}, {LBA: 200, Blocks: 28}},
+		{{LBA: 228, Blocks: 2}},
+	})
+
+	// both limits at once
+	batches = splitUnmap([]LBARange{{LBA: 0, Blocks: 10}, {LBA: 20, Blocks: 10}, {LBA: 40, Blocks: 10}},
+		BlockLimits{MaxUnmapLBACount: 15, MaxUnmapBlockDescriptorCount: 2})
+	assert.DeepEqual(t, batches, [][]LBARange{
+		{{LBA: 0, Blocks: 10}, {LBA: 20, Blocks: 5}},
+		{{LBA: 25, Blocks: 5}, {LBA: 40, Blocks: 10}},
+	})
+
+	// a target that reports no limits gets everything in one command
+	// and empty ranges are left out
+	batches = splitUnmap([]LBARange{{LBA: 0, Blocks: 10}, {LBA: 20, Blocks: 0}}, BlockLimits{})
+	assert.DeepEqual(t, batches, [][]LBARange{{{LBA: 0, Blocks: 10}}})
+	assert.Equal(t, len(splitUnmap(nil, BlockLimits{})), 0)
+}
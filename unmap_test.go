@@ -0,0 +1,58 @@
+package iscsi_test
+
+import (
+	"math"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestUnmap(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 10*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	limits, err := device.BlockLimits()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// gotgt only advertises unmap limits for thin provisioned LUNs
+	assert.Equal(t, uint32(limits.MaxUnmapLBACount), uint32(math.MaxUint32))
+	assert.Equal(t, limits.MaxUnmapBlockDescriptorCount, 16)
+
+	// more ranges than fit in one command
+	var ranges []iscsi.LBARange
+	for i := 0; i < 40; i++ {
+		ranges = append(ranges, iscsi.LBARange{LBA: i * 100, Blocks: 50})
+	}
+	err = device.Unmap(ranges)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// every extent the target reports within an unmapped range must no
+	// longer be mapped.  gotgt accepts GET LBA STATUS but never returns
+	// any descriptors, so against it this only checks the command works
+	for _, r := range ranges {
+		descriptors, err := device.GetLBAStatus(r.LBA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range descriptors {
+			if d.LBA >= r.LBA+r.Blocks || d.LBA+d.Blocks <= r.LBA {
+				continue
+			}
+			assert.Assert(t, d.Status == iscsi.ProvisioningDeallocated || d.Status == iscsi.ProvisioningAnchored,
+				"%+v overlaps unmapped range %+v", d, r)
+		}
+	}
+}
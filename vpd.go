@@ -0,0 +1,445 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"unsafe"
+)
+
+// Peripheral device types reported by INQUIRY
+const (
+	DeviceTypeBlock      = 0x00
+	DeviceTypeSequential = 0x01
+	DeviceTypeMMC        = 0x05
+	DeviceTypeEnclosure  = 0x0d
+	DeviceTypeUnknown    = 0x1f
+)
+
+// InquiryData is the standard INQUIRY data of a LUN
+type InquiryData struct {
+	// PeripheralQualifier is 0 when a device is connected to the LUN
+	PeripheralQualifier int
+	DeviceType          int
+	Removable           bool
+	// Version is the SPC version the target claims to conform to
+	Version  int
+	Vendor   string
+	Product  string
+	Revision string
+}
+
+func (d *device) Inquiry() (InquiryData, error) {
+	return d.InquiryContext(context.Background())
+}
+
+func (d *device) InquiryContext(ctx context.Context) (InquiryData, error) {
+	task, err := d.runIdempotentTask(ctx, "iscsi_inquiry_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_inquiry_task(d.root().Context, C.int(d.targetLun), 0, 0, 255, cb, pdata)
+	})
+	if err != nil {
+		return InquiryData{}, err
+	}
+	dataIn := C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size)
+	C.scsi_free_scsi_task(task)
+	inq, err := parseInquiry(dataIn)
+	if err != nil {
+		return inq, err
+	}
+	logger().Debug("Inquiry", slog.Any("inquiry", inq))
+	return inq, nil
+}
+
+func parseInquiry(data []byte) (InquiryData, error) {
+	if len(data) < 36 {
+		return InquiryData{}, fmt.Errorf("inquiry: short data (%d bytes)", len(data))
+	}
+	return InquiryData{
+		PeripheralQualifier: int(data[0] >> 5),
+		DeviceType:          int(data[0] & 0x1f),
+		Removable:           data[1]&0x80 != 0,
+		Version:             int(data[2]),
+		Vendor:              inquiryString(data[8:16]),
+		Product:             inquiryString(data[16:32]),
+		Revision:            inquiryString(data[32:36]),
+	}, nil
+}
+
+// inquiryString trims the space (or by some targets, NUL) padding
+// from an ASCII field
+func inquiryString(b []byte) string {
+	return strings.TrimRight(string(b), " \x00")
+}
+
+// inquiryVPD fetches a vital product data page, returning the whole
+// page including its 4 byte header
+func (d *device) inquiryVPD(ctx context.Context, page int) ([]byte, error) {
+	// most pages fit in this, if not we'll ask again with the
+	// length the target says it needs
+	allocLen := 255
+	for {
+		task, err := d.runIdempotentTask(ctx, "iscsi_inquiry_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+			return C.iscsi_inquiry_task(d.root().Context, C.int(d.targetLun), 1, C.int(page), C.int(allocLen), cb, pdata)
+		})
+		if err != nil {
+			return nil, err
+		}
+		dataIn := C.GoBytes(unsafe.Pointer(task.datain.data), task.datain.size)
+		C.scsi_free_scsi_task(task)
+		if len(dataIn) < 4 {
+			return nil, fmt.Errorf("vpd page 0x%02x: unexpected size", page)
+		}
+		if int(dataIn[1]) != page {
+			return nil, fmt.Errorf("vpd page 0x%02x: target returned page 0x%02x", page, dataIn[1])
+		}
+		pageLen := int(binary.BigEndian.Uint16(dataIn[2:4])) + 4
+		if pageLen > allocLen && allocLen < 0xffff {
+			allocLen = min(pageLen, 0xffff)
+			continue
+		}
+		return dataIn[:min(pageLen, len(dataIn))], nil
+	}
+}
+
+// SupportedVPDPages returns the VPD page codes the target supports
+func (d *device) SupportedVPDPages() ([]int, error) {
+	return d.SupportedVPDPagesContext(context.Background())
+}
+
+func (d *device) SupportedVPDPagesContext(ctx context.Context) ([]int, error) {
+	page, err := d.inquiryVPD(ctx, C.SCSI_INQUIRY_PAGECODE_SUPPORTED_VPD_PAGES)
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]int, 0, len(page)-4)
+	for _, code := range page[4:] {
+		pages = append(pages, int(code))
+	}
+	return pages, nil
+}
+
+// UnitSerialNumber returns the Unit Serial Number VPD page (0x80)
+func (d *device) UnitSerialNumber() (string, error) {
+	return d.UnitSerialNumberContext(context.Background())
+}
+
+func (d *device) UnitSerialNumberContext(ctx context.Context) (string, error) {
+	page, err := d.inquiryVPD(ctx, C.SCSI_INQUIRY_PAGECODE_UNIT_SERIAL_NUMBER)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimLeft(inquiryString(page[4:]), " "), nil
+}
+
+// DesignatorType is the kind of identifier in a Device Identification
+// designation descriptor
+type DesignatorType int
+
+const (
+	DesignatorVendorSpecific       DesignatorType = 0x0
+	DesignatorT10VendorID          DesignatorType = 0x1
+	DesignatorEUI64                DesignatorType = 0x2
+	DesignatorNAA                  DesignatorType = 0x3
+	DesignatorRelativeTargetPort   DesignatorType = 0x4
+	DesignatorTargetPortGroup      DesignatorType = 0x5
+	DesignatorLogicalUnitGroup     DesignatorType = 0x6
+	DesignatorMD5LogicalUnit       DesignatorType = 0x7
+	DesignatorSCSIName             DesignatorType = 0x8
+	DesignatorProtocolSpecificPort DesignatorType = 0x9
+	DesignatorUUID                 DesignatorType = 0xa
+)
+
+// Association is what a designator identifies
+type Association int
+
+const (
+	AssociationLogicalUnit  Association = 0
+	AssociationTargetPort   Association = 1
+	AssociationTargetDevice Association = 2
+)
+
+// Code sets of a designator's value
+const (
+	CodeSetBinary = 1
+	CodeSetASCII  = 2
+	CodeSetUTF8   = 3
+)
+
+// Designator is a single designation descriptor from the Device
+// Identification VPD page (0x83)
+type Designator struct {
+	Type        DesignatorType
+	Association Association
+	CodeSet     int
+	// ProtocolID is only meaningful when PIV is set
+	ProtocolID int
+	PIV        bool
+	Value      []byte
+}
+
+// String formats the designator the way Linux names devices
+// under /dev/disk/by-id, e.g. naa.60014055f5d6dbd0
+func (d Designator) String() string {
+	switch d.Type {
+	case DesignatorNAA:
+		return "naa." + hex.EncodeToString(d.Value)
+	case DesignatorEUI64:
+		return "eui." + hex.EncodeToString(d.Value)
+	case DesignatorT10VendorID:
+		return "t10." + inquiryString(d.Value)
+	}
+	if d.CodeSet == CodeSetASCII || d.CodeSet == CodeSetUTF8 {
+		return inquiryString(d.Value)
+	}
+	return hex.EncodeToString(d.Value)
+}
+
+// NAAType returns the NAA field of an NAA designator, which determines
+// its format (2, 3, 5 or 6)
+func (d Designator) NAAType() int {
+	if d.Type != DesignatorNAA || len(d.Value) == 0 {
+		return 0
+	}
+	return int(d.Value[0] >> 4)
+}
+
+// DeviceIdentification returns the designators from the Device
+// Identification VPD page (0x83)
+func (d *device) DeviceIdentification() ([]Designator, error) {
+	return d.DeviceIdentificationContext(context.Background())
+}
+
+func (d *device) DeviceIdentificationContext(ctx context.Context) ([]Designator, error) {
+	page, err := d.inquiryVPD(ctx, C.SCSI_INQUIRY_PAGECODE_DEVICE_IDENTIFICATION)
+	if err != nil {
+		return nil, err
+	}
+	return parseDeviceIdentification(page)
+}
+
+func parseDeviceIdentification(page []byte) ([]Designator, error) {
+	var designators []Designator
+	for off := 4; off < len(page); {
+		if off+4 > len(page) {
+			return designators, errors.New("device identification: truncated descriptor")
+		}
+		length := int(page[off+3])
+		if off+4+length > len(page) {
+			return designators, errors.New("device identification: truncated descriptor")
+		}
+		designators = append(designators, Designator{
+			ProtocolID:  int(page[off] >> 4),
+			CodeSet:     int(page[off] & 0x0f),
+			PIV:         page[off+1]&0x80 != 0,
+			Association: Association((page[off+1] >> 4) & 0x03),
+			Type:        DesignatorType(page[off+1] & 0x0f),
+			Value:       append([]byte(nil), page[off+4:off+4+length]...),
+		})
+		off += 4 + length
+	}
+	return designators, nil
+}
+
+// WWN returns the NAA designator of the LUN, formatted as naa.<hex>
+func (d *device) WWN() (string, error) {
+	return d.WWNContext(context.Background())
+}
+
+func (d *device) WWNContext(ctx context.Context) (string, error) {
+	designators, err := d.DeviceIdentificationContext(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, designator := range designators {
+		if designator.Type == DesignatorNAA && designator.Association == AssociationLogicalUnit {
+			return designator.String(), nil
+		}
+	}
+	return "", errors.New("target did not report an NAA designator for the LUN")
+}
+
+// BlockLimits is the Block Limits VPD page (0xB0).  Fields the target
+// doesn't report are zero, which for the maximums means there is no
+// limit that the target is willing to tell us about
+type BlockLimits struct {
+	// WSNZ is set when the target rejects WRITE SAME with
+	// a length of zero
+	WSNZ                             bool
+	MaxCompareAndWriteLength         int
+	OptimalTransferLengthGranularity int
+	MaxTransferLength                int
+	OptimalTransferLength            int
+	MaxPrefetchLength                int
+	MaxUnmapLBACount                 int
+	MaxUnmapBlockDescriptorCount     int
+	OptimalUnmapGranularity          int
+	// UnmapGranularityAlignment is only meaningful when
+	// UnmapGranularityAlignmentValid is set
+	UnmapGranularityAlignmentValid bool
+	UnmapGranularityAlignment      int
+	MaxWriteSameLength             int
+}
+
+func (d *device) BlockLimits() (BlockLimits, error) {
+	return d.BlockLimitsContext(context.Background())
+}
+
+func (d *device) BlockLimitsContext(ctx context.Context) (BlockLimits, error) {
+	page, err := d.inquiryVPD(ctx, C.SCSI_INQUIRY_PAGECODE_BLOCK_LIMITS)
+	if err != nil {
+		return BlockLimits{}, err
+	}
+	limits := parseBlockLimits(page)
+	logger().Debug("BlockLimits", slog.Any("limits", limits))
+	return limits, nil
+}
+
+// cachedBlockLimits returns the block limits of the LUN, only asking the
+// target the first time.  Targets that don't have the page are treated
+// as having no limits
+func (d *device) cachedBlockLimits(ctx context.Context) (BlockLimits, error) {
+	if d.blockLimits != nil {
+		return *d.blockLimits, nil
+	}
+	limits, err := d.BlockLimitsContext(ctx)
+	if errors.Is(err, ErrIllegalRequest) {
+		logger().Debug("target has no Block Limits VPD page", slog.Any("error", err))
+		limits, err = BlockLimits{}, nil
+		d.noBlockLimits = true
+	}
+	if err != nil {
+		return limits, err
+	}
+	d.blockLimits = &limits
+	return limits, nil
+}
+
+func parseBlockLimits(page []byte) BlockLimits {
+	// the page grew over time, pad it out so that anything an older
+	// target leaves off reads as zero
+	p := make([]byte, 64)
+	copy(p, page)
+	return BlockLimits{
+		WSNZ:                             p[4]&0x01 != 0,
+		MaxCompareAndWriteLength:         int(p[5]),
+		OptimalTransferLengthGranularity: int(binary.BigEndian.Uint16(p[6:8])),
+		MaxTransferLength:                int(binary.BigEndian.Uint32(p[8:12])),
+		OptimalTransferLength:            int(binary.BigEndian.Uint32(p[12:16])),
+		MaxPrefetchLength:                int(binary.BigEndian.Uint32(p[16:20])),
+		MaxUnmapLBACount:                 int(binary.BigEndian.Uint32(p[20:24])),
+		MaxUnmapBlockDescriptorCount:     int(binary.BigEndian.Uint32(p[24:28])),
+		OptimalUnmapGranularity:          int(binary.BigEndian.Uint32(p[28:32])),
+		UnmapGranularityAlignmentValid:   p[32]&0x80 != 0,
+		UnmapGranularityAlignment:        int(binary.BigEndian.Uint32(p[32:36]) & 0x7fffffff),
+		MaxWriteSameLength:               int(binary.BigEndian.Uint64(p[36:44])),
+	}
+}
+
+// BlockDeviceCharacteristics is the Block Device Characteristics
+// VPD page (0xB1)
+type BlockDeviceCharacteristics struct {
+	// RotationRate is the medium rotation rate in rpm, 1 for
+	// non-rotating media such as SSDs and 0 if not reported
+	RotationRate int
+	ProductType  int
+	// NominalFormFactor is 1 for 5.25", 2 for 3.5", 3 for 2.5",
+	// 4 for 1.8", 5 for less than 1.8" and 0 if not reported
+	NominalFormFactor int
+	// FUAB is set when SYNCHRONIZE CACHE only needs to cover writes
+	// that would have been made durable by FUA
+	FUAB bool
+	// VBULS is set when the target verifies blocks beyond what was
+	// written for VERIFY commands with BYTCHK set
+	VBULS bool
+}
+
+// NonRotating reports whether the medium is solid state
+func (c BlockDeviceCharacteristics) NonRotating() bool {
+	return c.RotationRate == 1
+}
+
+func (d *device) BlockDeviceCharacteristics() (BlockDeviceCharacteristics, error) {
+	return d.BlockDeviceCharacteristicsContext(context.Background())
+}
+
+func (d *device) BlockDeviceCharacteristicsContext(ctx context.Context) (BlockDeviceCharacteristics, error) {
+	page, err := d.inquiryVPD(ctx, C.SCSI_INQUIRY_PAGECODE_BLOCK_DEVICE_CHARACTERISTICS)
+	if err != nil {
+		return BlockDeviceCharacteristics{}, err
+	}
+	p := make([]byte, 64)
+	copy(p, page)
+	return BlockDeviceCharacteristics{
+		RotationRate:      int(binary.BigEndian.Uint16(p[4:6])),
+		ProductType:       int(p[6]),
+		NominalFormFactor: int(p[7] & 0x0f),
+		FUAB:              p[8]&0x02 != 0,
+		VBULS:             p[8]&0x01 != 0,
+	}, nil
+}
+
+// Provisioning types reported in LogicalBlockProvisioning
+const (
+	ProvisioningTypeFull     = 0
+	ProvisioningTypeResource = 1
+	ProvisioningTypeThin     = 2
+)
+
+// LogicalBlockProvisioning is the Logical Block Provisioning
+// VPD page (0xB2)
+type LogicalBlockProvisioning struct {
+	ThresholdExponent int
+	// Unmap (LBPU) is set when the target supports UNMAP
+	Unmap bool
+	// WriteSame16Unmap (LBPWS) and WriteSame10Unmap (LBPWS10) are set
+	// when the target supports the unmap bit of WRITE SAME
+	WriteSame16Unmap bool
+	WriteSame10Unmap bool
+	// ReadZeros is the LBPRZ field, non-zero when unmapped blocks
+	// read back as zeroes
+	ReadZeros int
+	// AnchorSupported is set when the target supports anchored blocks
+	AnchorSupported bool
+	// DescriptorPresent is set when a provisioning group descriptor
+	// follows the header
+	DescriptorPresent   bool
+	MinimumPercentage   int
+	ProvisioningType    int
+	ThresholdPercentage int
+}
+
+func (d *device) LogicalBlockProvisioning() (LogicalBlockProvisioning, error) {
+	return d.LogicalBlockProvisioningContext(context.Background())
+}
+
+func (d *device) LogicalBlockProvisioningContext(ctx context.Context) (LogicalBlockProvisioning, error) {
+	page, err := d.inquiryVPD(ctx, C.SCSI_INQUIRY_PAGECODE_LOGICAL_BLOCK_PROVISIONING)
+	if err != nil {
+		return LogicalBlockProvisioning{}, err
+	}
+	p := make([]byte, 8)
+	copy(p, page)
+	return LogicalBlockProvisioning{
+		ThresholdExponent:   int(p[4]),
+		Unmap:               p[5]&0x80 != 0,
+		WriteSame16Unmap:    p[5]&0x40 != 0,
+		WriteSame10Unmap:    p[5]&0x20 != 0,
+		ReadZeros:           int(p[5]>>2) & 0x07,
+		AnchorSupported:     p[5]&0x02 != 0,
+		DescriptorPresent:   p[5]&0x01 != 0,
+		MinimumPercentage:   int(p[6] >> 3),
+		ProvisioningType:    int(p[6] & 0x07),
+		ThresholdPercentage: int(p[7]),
+	}, nil
+}
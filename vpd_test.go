@@ -0,0 +1,56 @@
+package iscsi_test
+
+import (
+	"strings"
+	"testing"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestInquiry(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 10*MiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	inq, err := device.Inquiry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, inq.DeviceType, iscsi.DeviceTypeBlock)
+	assert.Equal(t, inq.Vendor, "GOSTOR")
+	assert.Equal(t, inq.Product, "GOTGT")
+
+	pages, err := device.SupportedVPDPages()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.DeepEqual(t, pages, []int{0x00, 0x80, 0x83, 0xb0, 0xb2})
+
+	serial, err := device.UnitSerialNumber()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, strings.HasPrefix(serial, "gotgt-"), serial)
+
+	// gotgt uses a locally assigned NAA
+	wwn, err := device.WWN()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, strings.HasPrefix(wwn, "naa.3"), wwn)
+
+	lbp, err := device.LogicalBlockProvisioning()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, lbp.Unmap)
+}
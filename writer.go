@@ -0,0 +1,109 @@
+package iscsi
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+)
+
+type readWriter struct {
+	*reader
+}
+
+// ReadWriter returns an io.ReadWriteSeeker, io.ReaderAt and io.WriterAt
+// over the whole device.  Writes that don't start or end on a block
+// boundary read the partial blocks first so that the bytes around the
+// write are preserved
+func ReadWriter(dev *device) (*readWriter, error) {
+	r, err := Reader(dev)
+	if err != nil {
+		return nil, err
+	}
+	return &readWriter{reader: r}, nil
+}
+
+// Close flushes the target's write cache before disconnecting so that
+// everything written is on stable storage
+func (w *readWriter) Close() error {
+	flushErr := w.dev.Flush()
+	if flushErr != nil {
+		flushErr = fmt.Errorf("iscsi device flush error: %w", flushErr)
+	}
+	return errors.Join(flushErr, w.reader.Close())
+}
+
+func (w *readWriter) Write(p []byte) (n int, err error) {
+	n, err = w.WriteAt(p, w.offset)
+	w.offset += int64(n)
+	return n, err
+}
+
+// WriteAt writes len(p) bytes at off.  If the write would run past the end
+// of the device then as much as fits is written and io.ErrShortWrite is
+// returned
+func (w *readWriter) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("iscsi.ReadWriter.WriteAt: negative offset")
+	}
+	size := w.blocksize * w.lba
+	if off >= size {
+		return 0, io.ErrShortWrite
+	}
+	var short bool
+	if off+int64(len(p)) > size {
+		p = p[:size-off]
+		short = true
+	}
+	logger().Debug("WriteAt", slog.Int("bytes", len(p)), slog.Int("offset", int(off)))
+
+	for len(p) > 0 {
+		lba := off / w.blocksize
+		blockOffset := off % w.blocksize
+		var written int
+		if blockOffset != 0 || int64(len(p)) < w.blocksize {
+			written, err = w.writePartialBlock(p, lba, blockOffset)
+		} else {
+			// the aligned middle goes out as whole blocks in one command
+			written = len(p) - len(p)%int(w.blocksize)
+			err = w.dev.Write16(Write16{
+				LBA:       int(lba),
+				Data:      p[:written],
+				BlockSize: int(w.blocksize),
+			})
+		}
+		if err != nil {
+			return n, fmt.Errorf("iscsi device write error: %w", err)
+		}
+		n += written
+		off += int64(written)
+		p = p[written:]
+	}
+	if short {
+		return n, io.ErrShortWrite
+	}
+	return n, nil
+}
+
+// writePartialBlock does a read-modify-write of a single block, copying in
+// as much of p as fits from blockOffset onwards
+func (w *readWriter) writePartialBlock(p []byte, lba, blockOffset int64) (int, error) {
+	block, err := w.dev.Read16(Read16{
+		LBA:       int(lba),
+		Blocks:    1,
+		BlockSize: int(w.blocksize),
+	})
+	if err != nil {
+		return 0, err
+	}
+	if int64(len(block)) != w.blocksize {
+		return 0, fmt.Errorf("expected %d bytes reading block %d, got %d", w.blocksize, lba, len(block))
+	}
+	n := copy(block[blockOffset:], p)
+	logger().Debug("read-modify-write", slog.Int("lba", int(lba)), slog.Int("bytes", n))
+	return n, w.dev.Write16(Write16{
+		LBA:       int(lba),
+		Data:      block,
+		BlockSize: int(w.blocksize),
+	})
+}
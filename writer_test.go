@@ -0,0 +1,130 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestWriteCopy(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	fileName := createTargetTempfile(t, 1*MiB)
+
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	rw, err := iscsi.ReadWriter(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := make([]byte, 1*MiB)
+	_, _ = rnd.Read(image)
+	// odd sized chunks so that most writes straddle block boundaries
+	n, err := io.CopyBuffer(rw, bytes.NewReader(image), make([]byte, 7*KiB+3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, n, int64(len(image)))
+
+	fileData, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(image, fileData))
+}
+
+// in order to test non block aligned writes we write randomly sized
+// []byte at random offsets to both a file and the iscsi io.WriterAt
+// and check that the device ends up identical to the file
+func TestWriteAtRandom(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	size := 1 * MiB
+	fileName := writeTargetTempfile(t, rnd, int64(size))
+	expected, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err = device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	rw, err := iscsi.ReadWriter(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		off := rnd.Intn(size)
+		data := make([]byte, rnd.Intn(min(4*KiB, size-off)+1))
+		_, _ = rnd.Read(data)
+		copy(expected[off:], data)
+		n, err := rw.WriteAt(data, int64(off))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, n, len(data))
+	}
+
+	actual := make([]byte, size)
+	if _, err := io.ReadFull(io.NewSectionReader(rw, 0, int64(size)), actual); err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(expected, actual))
+}
+
+func TestWriteShort(t *testing.T) {
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    createAndRunTestTarget(t, 4*KiB),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	rw, err := iscsi.ReadWriter(device)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = rw.Seek(-100, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := rw.Write(make([]byte, 200))
+	assert.Equal(t, err, io.ErrShortWrite)
+	assert.Equal(t, n, 100)
+
+	n, err = rw.Write([]byte{1})
+	assert.Equal(t, err, io.ErrShortWrite)
+	assert.Equal(t, n, 0)
+}
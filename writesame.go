@@ -0,0 +1,222 @@
+package iscsi
+
+/*
+#cgo pkg-config: libiscsi
+#include "iscsi/iscsi.h"
+#include "iscsi/scsi-lowlevel.h"
+*/
+import "C"
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"runtime"
+	"unsafe"
+)
+
+// the most blocks Zero asks the target to write with each WRITE SAME,
+// less if the target reports a lower MAXIMUM WRITE SAME LENGTH
+const zeroWriteSameBlocks = 1 << 16
+
+// how many bytes of zeroes Zero sends with each WRITE(16) when the
+// target doesn't support WRITE SAME without a data buffer
+const zeroWriteBytes = 1 << 20
+
+type WriteSame16 struct {
+	LBA       int
+	Blocks    int
+	BlockSize int
+	// Data is the single block written to every LBA in the range.  It
+	// must be empty when NDOB is set
+	Data []byte
+	// Unmap allows the target to deallocate the blocks instead of
+	// writing them, as long as reading them back returns Data
+	Unmap bool
+	// Anchor asks the target to anchor rather than deallocate the
+	// blocks when Unmap is set
+	Anchor bool
+	// NDOB (no data-out buffer) writes zeroes without sending a
+	// block of data to the target
+	NDOB bool
+}
+
+type WriteSame10 struct {
+	LBA       int
+	Blocks    int
+	BlockSize int
+	Data      []byte
+	Unmap     bool
+	Anchor    bool
+}
+
+func (d *device) WriteSame16(data WriteSame16) error {
+	return d.WriteSame16Context(context.Background(), data)
+}
+
+func (d *device) WriteSame16Context(ctx context.Context, data WriteSame16) error {
+	logger().Debug("WriteSame16", slog.Int("lba", data.LBA), slog.Int("blocks", data.Blocks),
+		slog.Bool("unmap", data.Unmap), slog.Bool("anchor", data.Anchor), slog.Bool("ndob", data.NDOB))
+	if data.Blocks <= 0 {
+		// a zero length means "to the end of the medium" to the target
+		return errors.New("WriteSame16: blocks must be positive")
+	}
+	if data.NDOB {
+		if len(data.Data) != 0 {
+			return errors.New("WriteSame16: data must be empty with NDOB")
+		}
+		task, err := d.runIdempotentTask(ctx, "iscsi_writesame16_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+			// libiscsi has no way to set NDOB so build the cdb ourselves
+			task := C.scsi_cdb_writesame16(0, cBool(data.Anchor), cBool(data.Unmap),
+				C.uint64_t(data.LBA), 0, C.uint32_t(data.Blocks), 0)
+			if task == nil {
+				return nil
+			}
+			task.cdb[1] |= 0x01
+			if C.iscsi_scsi_command_async(d.root().Context, C.int(d.targetLun), task, cb, nil, pdata) != 0 {
+				C.scsi_free_scsi_task(task)
+				return nil
+			}
+			return task
+		})
+		if err != nil {
+			return err
+		}
+		C.scsi_free_scsi_task(task)
+		return nil
+	}
+
+	if len(data.Data) != data.BlockSize {
+		return fmt.Errorf("WriteSame16: data must be exactly one block of %d bytes", data.BlockSize)
+	}
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	// libiscsi holds on to the buffer until the data has been sent
+	pinner.Pin(&data.Data[0])
+	task, err := d.runIdempotentTask(ctx, "iscsi_writesame16_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_writesame16_task(d.root().Context, C.int(d.targetLun), C.uint64_t(data.LBA),
+			(*C.uchar)(unsafe.Pointer(&data.Data[0])), C.uint32_t(len(data.Data)), C.uint32_t(data.Blocks),
+			cBool(data.Anchor), cBool(data.Unmap), 0, 0, cb, pdata)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
+func (d *device) WriteSame10(data WriteSame10) error {
+	return d.WriteSame10Context(context.Background(), data)
+}
+
+func (d *device) WriteSame10Context(ctx context.Context, data WriteSame10) error {
+	logger().Debug("WriteSame10", slog.Int("lba", data.LBA), slog.Int("blocks", data.Blocks),
+		slog.Bool("unmap", data.Unmap), slog.Bool("anchor", data.Anchor))
+	if data.Blocks <= 0 || data.Blocks > 0xffff {
+		return errors.New("WriteSame10: blocks must be between 1 and 65535")
+	}
+	if int64(data.LBA) > math.MaxUint32 {
+		return errors.New("WriteSame10: lba out of range, use WriteSame16")
+	}
+	if len(data.Data) != data.BlockSize {
+		return fmt.Errorf("WriteSame10: data must be exactly one block of %d bytes", data.BlockSize)
+	}
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(&data.Data[0])
+	task, err := d.runIdempotentTask(ctx, "iscsi_writesame10_task", func(cb C.iscsi_command_cb, pdata unsafe.Pointer) *C.struct_scsi_task {
+		return C.iscsi_writesame10_task(d.root().Context, C.int(d.targetLun), C.uint32_t(data.LBA),
+			(*C.uchar)(unsafe.Pointer(&data.Data[0])), C.uint32_t(len(data.Data)), C.uint16_t(data.Blocks),
+			cBool(data.Anchor), cBool(data.Unmap), 0, 0, cb, pdata)
+	})
+	if err != nil {
+		return err
+	}
+	C.scsi_free_scsi_task(task)
+	return nil
+}
+
+// Zero writes zeroes to blocks starting at lba.  When the target supports
+// it this is done with WRITE SAME(16) and NDOB so no data is sent over the
+// wire, otherwise it falls back to writing zero filled buffers
+func (d *device) Zero(lba, blocks int) error {
+	return d.ZeroContext(context.Background(), lba, blocks)
+}
+
+func (d *device) ZeroContext(ctx context.Context, lba, blocks int) error {
+	c, err := d.ReadCapacityContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get capacity of device: %w", err)
+	}
+	end := lba + blocks
+	if lba < 0 || blocks < 0 || end > c.MaxLBA+1 {
+		return fmt.Errorf("Zero: range %d+%d is outside the device", lba, blocks)
+	}
+	limits, err := d.cachedBlockLimits(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get block limits of device: %w", err)
+	}
+	chunk := zeroWriteSameBlocks
+	if limits.MaxWriteSameLength > 0 {
+		chunk = min(limits.MaxWriteSameLength, chunk)
+	}
+
+	for !d.noWriteSameNDOB && lba < end {
+		n := min(end-lba, chunk)
+		err := d.WriteSame16Context(ctx, WriteSame16{
+			LBA:       lba,
+			Blocks:    n,
+			BlockSize: c.BlockSize,
+			NDOB:      true,
+		})
+		if invalidFieldInCDB(err) && limits.MaxWriteSameLength == 0 && n > 1 {
+			// the target didn't report a limit, so it may just
+			// be that the request was too long
+			chunk = n / 2
+			continue
+		}
+		if errors.Is(err, ErrIllegalRequest) {
+			logger().Debug("target rejected WRITE SAME with NDOB, falling back to WRITE", slog.Any("error", err))
+			d.noWriteSameNDOB = true
+			break
+		}
+		if err != nil {
+			return err
+		}
+		lba += n
+	}
+
+	zeroes := make([]byte, min(zeroWriteBytes/c.BlockSize, end-lba)*c.BlockSize)
+	for lba < end {
+		n := min(end-lba, len(zeroes)/c.BlockSize)
+		err := d.Write16Context(ctx, Write16{
+			LBA:       lba,
+			Data:      zeroes[:n*c.BlockSize],
+			BlockSize: c.BlockSize,
+		})
+		if err != nil {
+			return err
+		}
+		lba += n
+	}
+	return nil
+}
+
+// the additional sense code for INVALID FIELD IN CDB
+const ascInvalidFieldInCDB = 0x24
+
+// invalidFieldInCDB reports whether err is the target rejecting a field
+// of the command, such as a length it won't accept
+func invalidFieldInCDB(err error) bool {
+	var scsiErr *SCSIError
+	return errors.As(err, &scsiErr) && errors.Is(scsiErr, ErrIllegalRequest) && scsiErr.ASC == ascInvalidFieldInCDB
+}
+
+func cBool(b bool) C.int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,86 @@
+package iscsi_test
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+
+	iscsi "github.com/willgorman/libiscsi-go"
+	"gotest.tools/assert"
+)
+
+func TestWriteSame16(t *testing.T) {
+	fileName := createTargetTempfile(t, 1*MiB)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	block := bytes.Repeat([]byte("iscsi!"), 512/6+1)[:512]
+	err = device.WriteSame16(iscsi.WriteSame16{LBA: 8, Blocks: 16, BlockSize: 512, Data: block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileData, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(fileData[8*512:24*512], bytes.Repeat(block, 16)))
+	assert.Assert(t, bytes.Equal(fileData[:8*512], make([]byte, 8*512)))
+	assert.Assert(t, bytes.Equal(fileData[24*512:], make([]byte, len(fileData)-24*512)))
+
+	err = device.WriteSame10(iscsi.WriteSame10{LBA: 100, Blocks: 4, BlockSize: 512, Data: block})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileData, err = os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(fileData[100*512:104*512], bytes.Repeat(block, 4)))
+}
+
+func TestZero(t *testing.T) {
+	seed := time.Now().UnixNano()
+	t.Logf("using seed %d", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	fileName := writeTargetTempfile(t, rnd, 4*MiB)
+	device := iscsi.New(iscsi.ConnectionDetails{
+		InitiatorIQN: "iqn.2024-10.libiscsi:go",
+		TargetURL:    runTestTarget(t, fileName),
+	})
+	err := device.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = device.Disconnect()
+	}()
+
+	before, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// zero everything but the first and last block
+	blocks := 4*MiB/512 - 2
+	err = device.Zero(1, blocks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	after, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Assert(t, bytes.Equal(after[:512], before[:512]))
+	assert.Assert(t, bytes.Equal(after[512:len(after)-512], make([]byte, blocks*512)))
+	assert.Assert(t, bytes.Equal(after[len(after)-512:], before[len(before)-512:]))
+}